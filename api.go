@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/SourceForgery/duc2mqtt/bastec"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var _ Sink = (*apiSink)(nil)
+
+// ApiPoint is a point as returned by the REST API.
+type ApiPoint struct {
+	bastec.PointConfig
+	Value *float64   `json:"value"`
+	Time  *time.Time `json:"time"`
+}
+
+// apiSink serves the polled points with their latest values, from the registry, over HTTP.
+type apiSink struct {
+	ducClient *bastec.BastecClient
+	registry  *bastec.PointRegistry
+	mutex     sync.RWMutex
+	points    []bastec.PointConfig
+}
+
+func newApiSink(mux *http.ServeMux, ducClient *bastec.BastecClient, registry *bastec.PointRegistry, allowWrites bool) *apiSink {
+	sink := &apiSink{
+		ducClient: ducClient,
+		registry:  registry,
+	}
+	mux.HandleFunc("GET /api/points", sink.listPoints)
+	mux.HandleFunc("GET /api/points/{pid}", sink.getPoint)
+	mux.HandleFunc("PUT /api/points/{pid}", writeHandler(allowWrites, sink.putPoint))
+	return sink
+}
+
+func (sink *apiSink) Name() string {
+	return "api"
+}
+
+func (sink *apiSink) PublishPoints(points []bastec.PointConfig) error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	sink.points = points
+	return nil
+}
+
+// PublishValues does nothing, the values are served from the registry.
+func (sink *apiSink) PublishValues(_ time.Time, _ []bastec.Point) error {
+	return nil
+}
+
+// point returns the point with its latest value. Must be called with the mutex held.
+func (sink *apiSink) point(pid string) (apiPoint ApiPoint, found bool) {
+	for _, point := range sink.points {
+		if point.Pid == pid {
+			return sink.withValue(point), true
+		}
+	}
+	return
+}
+
+// withValue merges the latest value into the point.
+func (sink *apiSink) withValue(point bastec.PointConfig) ApiPoint {
+	apiPoint := ApiPoint{PointConfig: point}
+	if registeredPoint, found := sink.registry.Point(point.Pid); found && registeredPoint.HasValue {
+		apiPoint.Value = &registeredPoint.Value
+		apiPoint.Time = &registeredPoint.Time
+	}
+	return apiPoint
+}
+
+func (sink *apiSink) listPoints(w http.ResponseWriter, _ *http.Request) {
+	sink.mutex.RLock()
+	apiPoints := make([]ApiPoint, 0, len(sink.points))
+	for _, point := range sink.points {
+		apiPoints = append(apiPoints, sink.withValue(point))
+	}
+	sink.mutex.RUnlock()
+	writeJson(w, http.StatusOK, apiPoints)
+}
+
+func (sink *apiSink) getPoint(w http.ResponseWriter, r *http.Request) {
+	sink.mutex.RLock()
+	apiPoint, found := sink.point(r.PathValue("pid"))
+	sink.mutex.RUnlock()
+	if !found {
+		writeJsonError(w, http.StatusNotFound, "no such point")
+		return
+	}
+	writeJson(w, http.StatusOK, apiPoint)
+}
+
+func (sink *apiSink) putPoint(w http.ResponseWriter, r *http.Request) {
+	pid := r.PathValue("pid")
+	sink.mutex.RLock()
+	apiPoint, found := sink.point(pid)
+	sink.mutex.RUnlock()
+	if !found {
+		writeJsonError(w, http.StatusNotFound, "no such point")
+		return
+	}
+	if !bastec.ParseAccessMode(apiPoint.Acc).CanWrite() {
+		writeJsonError(w, http.StatusForbidden, "point is not writable")
+		return
+	}
+
+	var body struct {
+		Value *float64 `json:"value"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Value == nil {
+		writeJsonError(w, http.StatusBadRequest, "expected a body like {\"value\": 21.5}")
+		return
+	}
+
+	if err := sink.ducClient.SetValue(pid, *body.Value); err != nil {
+		log.Error().Err(err).Msgf("Failed to set %s to %f", pid, *body.Value)
+		writeJsonError(w, http.StatusBadGateway, "failed to write to the DUC")
+		return
+	}
+	log.Info().Msgf("Set %s to %f", pid, *body.Value)
+
+	// The written value is served until the next poll
+	written, _ := sink.registry.Point(pid)
+	var values bastec.ValuesResponse
+	values.Result.Timet = time.Now().Unix()
+	values.Result.Points = []bastec.Point{{Pid: pid, Value: *body.Value, Decimals: written.Decimals, DecimalsShown: written.DecimalsShown}}
+	sink.registry.MergeValues(&values)
+
+	sink.mutex.RLock()
+	apiPoint, _ = sink.point(pid)
+	sink.mutex.RUnlock()
+	writeJson(w, http.StatusOK, apiPoint)
+}
+
+func writeJson(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Debug().Err(err).Msg("Failed to write http response")
+	}
+}
+
+func writeJsonError(w http.ResponseWriter, status int, message string) {
+	writeJson(w, status, map[string]string{"error": message})
+}
@@ -1,9 +1,8 @@
 package bastec
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
-	"fmt"
 	"github.com/rotisserie/eris"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -23,8 +22,8 @@ type BrowseResponse struct {
 		DevId  string        `json:"devid"`
 		Points []PointConfig `json:"points"`
 	} `json:"result"`
-	Error string `json:"error"`
-	Id    int    `json:"id"`
+	Error *RPCError `json:"error"`
+	Id    int       `json:"id"`
 }
 
 func (bastecClient *BastecClient) Browse() (valueResponse *BrowseResponse, err error) {
@@ -33,7 +32,7 @@ func (bastecClient *BastecClient) Browse() (valueResponse *BrowseResponse, err e
 		Method:         "pdb.browse",
 	}
 
-	response, err := bastecClient.jsonRpc(rpcRequest)
+	response, err := bastecClient.jsonRpc(context.Background(), rpcRequest)
 	if err != nil {
 		return nil, eris.Wrapf(err, "failed to execute jsonRPC")
 	}
@@ -51,9 +50,8 @@ func (bastecClient *BastecClient) Browse() (valueResponse *BrowseResponse, err e
 	for _, point := range browseResponse.Result.Points {
 		logger().Debug().Msgf("Found sensor '%s' on device '%s' with ", point.Pid, browseResponse.Result.DevId)
 	}
-	if browseResponse.Error != "" {
-		err = errors.New(fmt.Sprintf("browse error: %s", browseResponse.Error))
+	if err = rpcError(rpcRequest.Method, browseResponse.Error); err != nil {
+		return nil, err
 	}
-
 	return &browseResponse, nil
 }
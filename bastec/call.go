@@ -0,0 +1,40 @@
+package bastec
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/rotisserie/eris"
+)
+
+// Call sends any JSON-RPC method to the DUC, for methods that have no wrapper of their own.
+// params are marshalled as they are, and the result of the response is decoded into result unless it's nil.
+// An error returned by the DUC is an *RPCError.
+func (bastecClient *BastecClient) Call(ctx context.Context, method string, params any, result any) error {
+	var rpcRequest = JsonRpcRequest{
+		JsonRpcVersion: "2.0",
+		Method:         method,
+		Params:         params,
+	}
+
+	jsonResponse, err := bastecClient.jsonRpc(ctx, rpcRequest)
+	if err != nil {
+		return eris.Wrapf(err, "failed %s jsonRpc request", method)
+	}
+	logger().Debug().Msg(string(jsonResponse))
+	var response struct {
+		Result json.RawMessage `json:"result"`
+		Error  *RPCError       `json:"error"`
+	}
+	if err = json.Unmarshal(jsonResponse, &response); err != nil {
+		return eris.Wrap(err, "failed to parse json")
+	}
+	if err = rpcError(method, response.Error); err != nil {
+		return err
+	}
+	if result != nil && len(response.Result) > 0 {
+		if err = json.Unmarshal(response.Result, result); err != nil {
+			return eris.Wrapf(err, "failed to parse the result of %s", method)
+		}
+	}
+	return nil
+}
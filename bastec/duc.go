@@ -2,6 +2,7 @@ package bastec
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
@@ -14,6 +15,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 )
 
 var lg *zerolog.Logger
@@ -26,22 +28,55 @@ func logger() *zerolog.Logger {
 	return lg
 }
 
+// BastecClient is safe for concurrent use.
+//
 //goland:noinspection GoNameStartsWithPackageName
 type BastecClient struct {
-	sessionId          string
+	loginURL           url.URL
+	password           string
 	RequestURL         url.URL
-	serial             int
 	DisallowedPrefixes []string
+	// MaxPointsPerRequest splits GetValues into several requests with at most this many points. 0 means no limit.
+	MaxPointsPerRequest int
+	// MaxConcurrentRequests is how many of the requests of GetValues may be in flight at once. Defaults to 1.
+	MaxConcurrentRequests int
+
+	// mutex guards the session and serial, which all requests share.
+	mutex        sync.Mutex
+	sessionId    string
+	session      Session
+	sessionValid bool
+	serial       int
+	// loginMutex lets only one caller log in at a time. The others wait for it and then use its session.
+	loginMutex sync.Mutex
+
+	httpClient *http.Client
+	counters   *transportCounters
 }
 
 type JsonRpcRequest struct {
-	JsonRpcVersion string     `json:"json-rpc"`
-	Method         string     `json:"method"`
-	Params         [][]string `json:"params,omitempty"`
-	Id             int        `json:"id"`
+	JsonRpcVersion string `json:"json-rpc"`
+	Method         string `json:"method"`
+	// Params are marshalled as they are, most methods take a list of lists of strings.
+	Params any `json:"params,omitempty"`
+	Id     int `json:"id"`
 }
 
+// Connect creates a client and logs in to the DUC.
 func Connect(url url.URL) (bastecClient *BastecClient, err error) {
+	bastecClient, err = NewClient(url)
+	if err != nil {
+		return nil, err
+	}
+	if err = bastecClient.Login(); err != nil {
+		return nil, err
+	}
+	return bastecClient, nil
+}
+
+// NewClient creates a client without contacting the DUC. Call Login before using it, or let the first
+// request log in when the DUC rejects it.
+func NewClient(url url.URL) (bastecClient *BastecClient, err error) {
 	if url.Path != "" {
 		return nil, errors.New("invalid url path. It must be empty")
 	}
@@ -60,47 +95,128 @@ func Connect(url url.URL) (bastecClient *BastecClient, err error) {
 	query.Add("username", user)
 	requesterURL.RawQuery = query.Encode()
 	requesterURL.User = nil
-	logger().Debug().Msgf("connecting to bastec '%s'", requesterURL.String())
-	saltResponse, err := getSalts(requesterURL)
-	if err != nil {
-		return
-	}
-
-	sessionId, err := login(requesterURL, password, saltResponse)
-	if err != nil {
-		return
-	}
 
 	rpcURL := requesterURL
 	rpcURL.Path = "if/json_rpc.js"
 	rpcURL.RawQuery = ""
 
-	logger().Info().Msgf("Connected to bastec duc '%s'", requesterURL.String())
-
+	counters := &transportCounters{}
 	bastecClient = &BastecClient{
-		sessionId:  sessionId,
+		loginURL:   requesterURL,
+		password:   password,
 		RequestURL: rpcURL,
+		httpClient: newHttpClient(counters),
+		counters:   counters,
 	}
 	return
 }
 
-func (bastecClient *BastecClient) GetVersion() (response []byte, err error) {
-	var rpcRequest = JsonRpcRequest{
-		JsonRpcVersion: "2.0",
-		Method:         "pdb.version",
+// Login logs in to the DUC with the credentials given to NewClient.
+func (bastecClient *BastecClient) Login() error {
+	bastecClient.loginMutex.Lock()
+	defer bastecClient.loginMutex.Unlock()
+	logger().Debug().Msgf("connecting to bastec '%s'", bastecClient.loginURL.String())
+	if err := bastecClient.logIn(); err != nil {
+		return err
+	}
+	logger().Info().Msgf("Connected to bastec duc '%s'", bastecClient.loginURL.String())
+	return nil
+}
+
+// Relogin logs in again with the credentials given to Connect, replacing the current session.
+func (bastecClient *BastecClient) Relogin() error {
+	bastecClient.loginMutex.Lock()
+	defer bastecClient.loginMutex.Unlock()
+	return bastecClient.relogin()
+}
+
+// reloginIfExpired logs in again unless another caller already replaced the expired session while this one
+// waited for its turn.
+func (bastecClient *BastecClient) reloginIfExpired(expiredSessionId string) error {
+	bastecClient.loginMutex.Lock()
+	defer bastecClient.loginMutex.Unlock()
+	if bastecClient.currentSessionId() != expiredSessionId {
+		return nil
 	}
+	return bastecClient.relogin()
+}
 
-	response, err = bastecClient.jsonRpc(rpcRequest)
+// relogin must be called with the loginMutex held.
+func (bastecClient *BastecClient) relogin() error {
+	logger().Info().Msgf("Logging in to bastec duc '%s' again", bastecClient.loginURL.String())
+	return bastecClient.logIn()
+}
+
+// logIn must be called with the loginMutex held.
+func (bastecClient *BastecClient) logIn() (err error) {
+	saltResponse, err := getSalts(bastecClient.httpClient, bastecClient.loginURL)
 	if err != nil {
-		return nil, eris.Wrap(err, "failed to execute GetVersion jsonRPC")
+		return eris.Wrap(err, "failed to get salts")
 	}
-	return
+	sessionId, session, err := login(bastecClient.httpClient, bastecClient.loginURL, bastecClient.password, saltResponse)
+	if err != nil {
+		return eris.Wrap(err, "failed to log in")
+	}
+	bastecClient.mutex.Lock()
+	defer bastecClient.mutex.Unlock()
+	bastecClient.sessionId = sessionId
+	bastecClient.session = session
+	bastecClient.sessionValid = true
+	return nil
+}
 
+func (bastecClient *BastecClient) currentSessionId() string {
+	bastecClient.mutex.Lock()
+	defer bastecClient.mutex.Unlock()
+	return bastecClient.sessionId
 }
 
-func (bastecClient *BastecClient) jsonRpc(request JsonRpcRequest) (body []byte, err error) {
+func (bastecClient *BastecClient) nextRequestId() int {
+	bastecClient.mutex.Lock()
+	defer bastecClient.mutex.Unlock()
 	bastecClient.serial++
-	request.Id = bastecClient.serial
+	return bastecClient.serial
+}
+
+func (bastecClient *BastecClient) setSessionValid(sessionValid bool) {
+	bastecClient.mutex.Lock()
+	defer bastecClient.mutex.Unlock()
+	bastecClient.sessionValid = sessionValid
+}
+
+// Session returns the user and site information the DUC returned when logging in.
+func (bastecClient *BastecClient) Session() Session {
+	bastecClient.mutex.Lock()
+	defer bastecClient.mutex.Unlock()
+	return bastecClient.session
+}
+
+// SessionValid is false if the DUC rejected the session on the last request.
+func (bastecClient *BastecClient) SessionValid() bool {
+	bastecClient.mutex.Lock()
+	defer bastecClient.mutex.Unlock()
+	return bastecClient.sessionValid
+}
+
+// jsonRpc sends a request to the DUC. If the DUC has expired the session, it logs in again and
+// retries the request once.
+func (bastecClient *BastecClient) jsonRpc(ctx context.Context, request JsonRpcRequest) (body []byte, err error) {
+	body, sessionId, expired, err := bastecClient.postJsonRpc(ctx, request)
+	if !expired {
+		return
+	}
+	logger().Info().Msg("The DUC rejected the session")
+	if err = bastecClient.reloginIfExpired(sessionId); err != nil {
+		return nil, eris.Wrap(err, "failed to log in again after the session expired")
+	}
+	body, _, _, err = bastecClient.postJsonRpc(ctx, request)
+	return
+}
+
+// postJsonRpc sends a single request with the current session. expired is set if the DUC rejected the session.
+func (bastecClient *BastecClient) postJsonRpc(ctx context.Context, request JsonRpcRequest) (body []byte, sessionId string, expired bool, err error) {
+	sessionId = bastecClient.currentSessionId()
+	request.Id = bastecClient.nextRequestId()
 
 	jsonBody, err := json.Marshal(request)
 	if err != nil {
@@ -110,7 +226,7 @@ func (bastecClient *BastecClient) jsonRpc(request JsonRpcRequest) (body []byte,
 	logger().Trace().Msgf("jsonRpc request body: %s", string(jsonBody))
 
 	requestUrl := bastecClient.RequestURL.String()
-	req, err := http.NewRequest(http.MethodPost, requestUrl, reader)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, requestUrl, reader)
 	if err != nil {
 		logger().
 			Error().
@@ -118,15 +234,22 @@ func (bastecClient *BastecClient) jsonRpc(request JsonRpcRequest) (body []byte,
 			Msg("failed to create new request")
 	}
 	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Cookie", fmt.Sprintf("SESSION_ID=%s", bastecClient.sessionId))
+	req.Header.Add("Cookie", fmt.Sprintf("SESSION_ID=%s", sessionId))
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := bastecClient.httpClient.Do(req)
 	if err != nil {
-		return nil, err
+		return
+	}
+	defer closeBody(res)
+	if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+		bastecClient.setSessionValid(false)
+		expired = true
 	}
 	if res.StatusCode != 200 {
-		return nil, errors.New(fmt.Sprintf("http error code %d", res.StatusCode))
+		err = newHTTPStatusError(res)
+		return
 	}
+	bastecClient.setSessionValid(true)
 	responseBody, err := io.ReadAll(res.Body)
 
 	if err != nil {
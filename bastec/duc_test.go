@@ -0,0 +1,229 @@
+package bastec
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDuc is a DUC with a single user, admin with the password secret, which answers pdb.getvalue with the
+// number of each pid as its value.
+type fakeDuc struct {
+	server *httptest.Server
+
+	mutex     sync.Mutex
+	sessionId string
+	logins    int
+	requests  int
+	// rejected is how many requests were answered with 401 because of the session.
+	rejected int
+	// delay is how long to wait before answering requests, and failing makes them fail with 500.
+	delay   time.Duration
+	failing bool
+}
+
+func newFakeDuc(t *testing.T) *fakeDuc {
+	t.Helper()
+	duc := &fakeDuc{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /if/login.js", duc.login)
+	mux.HandleFunc("POST /if/json_rpc.js", duc.jsonRpc)
+	duc.server = httptest.NewServer(mux)
+	t.Cleanup(duc.server.Close)
+	return duc
+}
+
+// newTestClient connects to the DUC as its only user.
+func newTestClient(t *testing.T, duc *fakeDuc) *BastecClient {
+	t.Helper()
+	client, err := Connect(duc.url("admin", "secret"))
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	return client
+}
+
+// url is the url of the DUC with the given credentials.
+func (duc *fakeDuc) url(user string, password string) url.URL {
+	ducUrl, _ := url.Parse(duc.server.URL)
+	ducUrl.User = url.UserPassword(user, password)
+	return *ducUrl
+}
+
+// expireSession makes the DUC forget the session, like it does when it restarts.
+func (duc *fakeDuc) expireSession() {
+	duc.mutex.Lock()
+	defer duc.mutex.Unlock()
+	duc.sessionId = ""
+}
+
+// answerWith makes the DUC wait for delay before answering, and answer with 500 if failing.
+func (duc *fakeDuc) answerWith(delay time.Duration, failing bool) {
+	duc.mutex.Lock()
+	defer duc.mutex.Unlock()
+	duc.delay = delay
+	duc.failing = failing
+}
+
+func (duc *fakeDuc) stats() (logins int, requests int, rejected int) {
+	duc.mutex.Lock()
+	defer duc.mutex.Unlock()
+	return duc.logins, duc.requests, duc.rejected
+}
+
+var fakeDucSalts = Salts{SaltA: []byte("abc"), SaltB: []byte("def")}
+
+func (duc *fakeDuc) login(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("username") != "ADMIN" {
+		// The DUC has no salts for users it doesn't know
+		writeTestJson(w, Salts{})
+		return
+	}
+	if query.Get("hash") == "" {
+		writeTestJson(w, fakeDucSalts)
+		return
+	}
+	if query.Get("hash") != generateBastecHash("secret", fakeDucSalts) {
+		// The DUC answers a wrong password without a user
+		writeTestJson(w, Session{})
+		return
+	}
+	duc.mutex.Lock()
+	duc.logins++
+	duc.sessionId = fmt.Sprintf("session-%d", duc.logins)
+	sessionId := duc.sessionId
+	duc.mutex.Unlock()
+	http.SetCookie(w, &http.Cookie{Name: "SESSION_ID", Value: sessionId})
+	writeTestJson(w, Session{Name: "Test", UserId: "ADMIN", Company: "ACME", City: "Lund"})
+}
+
+func (duc *fakeDuc) jsonRpc(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie("SESSION_ID")
+	duc.mutex.Lock()
+	duc.requests++
+	valid := err == nil && duc.sessionId != "" && cookie.Value == duc.sessionId
+	if !valid {
+		duc.rejected++
+	}
+	delay, failing := duc.delay, duc.failing
+	duc.mutex.Unlock()
+	// The body is read first, so that the server notices when the client gives up waiting
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	select {
+	case <-time.After(delay):
+	case <-r.Context().Done():
+		return
+	}
+	if !valid {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if failing {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var request struct {
+		Id     int        `json:"id"`
+		Method string     `json:"method"`
+		Params [][]string `json:"params"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if request.Method != "pdb.getvalue" || len(request.Params) != 1 {
+		writeTestJson(w, map[string]any{"id": request.Id, "error": "unknown method " + request.Method})
+		return
+	}
+	var response ValuesResponse
+	response.Id = request.Id
+	response.Result.Timet = time.Now().Unix()
+	for i, pid := range request.Params[0] {
+		response.Result.Points = append(response.Result.Points, Point{Pid: pid, Value: float64(i), Decimals: 1})
+	}
+	writeTestJson(w, response)
+}
+
+func writeTestJson(w http.ResponseWriter, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func TestConcurrentGetValuesLogsInOnceWhenTheSessionExpires(t *testing.T) {
+	duc := newFakeDuc(t)
+	client := newTestClient(t, duc)
+	client.MaxPointsPerRequest = 2
+	client.MaxConcurrentRequests = 4
+	pids := []string{"1.ai.1", "1.ai.2", "1.ai.3", "1.ai.4", "1.ai.5"}
+
+	getValuesConcurrently := func() {
+		t.Helper()
+		var wg sync.WaitGroup
+		errs := make(chan error, 20)
+		for range 20 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				values, err := client.GetValues(pids)
+				if err == nil && len(values.Result.Points) != len(pids) {
+					err = fmt.Errorf("got %d values, expected %d", len(values.Result.Points), len(pids))
+				}
+				if err != nil {
+					errs <- err
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Error(err)
+		}
+	}
+
+	getValuesConcurrently()
+	if logins, _, rejected := duc.stats(); logins != 1 || rejected != 0 {
+		t.Fatalf("logged in %d times with %d rejected requests before the session expired, expected once and none", logins, rejected)
+	}
+
+	duc.expireSession()
+	getValuesConcurrently()
+	logins, _, rejected := duc.stats()
+	if logins != 2 {
+		t.Errorf("logged in %d times in all, expected a single login after the session expired", logins)
+	}
+	if rejected == 0 {
+		t.Error("no request was rejected, the session never expired")
+	}
+	if !client.SessionValid() {
+		t.Error("the session isn't valid after logging in again")
+	}
+}
+
+func TestLoginErrors(t *testing.T) {
+	duc := newFakeDuc(t)
+
+	_, err := Connect(duc.url("admin", "wrong"))
+	if !errors.Is(err, ErrWrongPassword) || !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("got %v with a wrong password, expected ErrWrongPassword", err)
+	}
+	_, err = Connect(duc.url("nobody", "secret"))
+	if !errors.Is(err, ErrUnknownUser) || !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("got %v with an unknown user, expected ErrUnknownUser", err)
+	}
+	if logins, _, _ := duc.stats(); logins != 0 {
+		t.Errorf("logged in %d times, expected none", logins)
+	}
+}
@@ -0,0 +1,88 @@
+package bastec
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+var (
+	// ErrAuthFailed is returned when the DUC doesn't accept the credentials. It's wrapped by
+	// ErrUnknownUser and ErrWrongPassword, which tell why.
+	ErrAuthFailed = errors.New("authentication failed")
+	// ErrUnknownUser is returned when the DUC has no salts for the user, i.e. doesn't know it.
+	ErrUnknownUser = fmt.Errorf("%w: unknown user", ErrAuthFailed)
+	// ErrWrongPassword is returned when the DUC knows the user but doesn't accept the password.
+	ErrWrongPassword = fmt.Errorf("%w: wrong password", ErrAuthFailed)
+	// ErrSessionExpired is matched by an *HTTPStatusError when the DUC rejected the session,
+	// even after logging in again.
+	ErrSessionExpired = errors.New("session expired")
+)
+
+// HTTPStatusError is returned when the DUC answers with another http status than 200 OK.
+type HTTPStatusError struct {
+	StatusCode int
+	Status     string
+	Url        string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("http error code %d from %s", e.StatusCode, e.Url)
+}
+
+// Is makes errors.Is(err, ErrSessionExpired) true when the DUC rejected the session.
+func (e *HTTPStatusError) Is(target error) bool {
+	return target == ErrSessionExpired && (e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden)
+}
+
+func newHTTPStatusError(res *http.Response) *HTTPStatusError {
+	return &HTTPStatusError{
+		StatusCode: res.StatusCode,
+		Status:     res.Status,
+		Url:        redactedUrl(res.Request.URL),
+	}
+}
+
+// redactedUrl leaves out the password and the query of a url, which holds the login hash when logging in.
+func redactedUrl(requestUrl *url.URL) string {
+	redacted := *requestUrl
+	redacted.RawQuery = ""
+	return redacted.Redacted()
+}
+
+// RPCError is an error returned by the DUC in a JSON-RPC response.
+type RPCError struct {
+	// Method is the JSON-RPC method that failed.
+	Method  string `json:"-"`
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	if e.Code != 0 {
+		return fmt.Sprintf("%s failed: %s (code %d)", e.Method, e.Message, e.Code)
+	}
+	return fmt.Sprintf("%s failed: %s", e.Method, e.Message)
+}
+
+// UnmarshalJSON accepts both an error object and a plain error message.
+func (e *RPCError) UnmarshalJSON(data []byte) error {
+	var message string
+	if err := json.Unmarshal(data, &message); err == nil {
+		*e = RPCError{Message: message}
+		return nil
+	}
+	type plainRPCError RPCError
+	return json.Unmarshal(data, (*plainRPCError)(e))
+}
+
+// rpcError returns the error of a response, if any, as an error of the method.
+func rpcError(method string, responseError *RPCError) error {
+	if responseError == nil || (responseError.Message == "" && responseError.Code == 0) {
+		return nil
+	}
+	responseError.Method = method
+	return responseError
+}
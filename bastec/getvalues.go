@@ -1,10 +1,12 @@
 package bastec
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/rotisserie/eris"
+	"strings"
+	"sync"
 )
 
 type Point struct {
@@ -21,11 +23,106 @@ type ValuesResponse struct {
 		Times  string  `json:"times"`
 		Points []Point `json:"points"`
 	} `json:"result"`
-	Error string `json:"error"`
-	Id    int    `json:"id"`
+	Error *RPCError `json:"error"`
+	Id    int       `json:"id"`
 }
 
+// ChunkError is a failed request for some of the points passed to GetValues.
+type ChunkError struct {
+	Pids []string
+	Err  error
+}
+
+// PartialValuesError is returned by GetValues along with the values that could be fetched,
+// when some but not all of its requests failed.
+type PartialValuesError struct {
+	Chunks []ChunkError
+}
+
+func (e *PartialValuesError) Error() string {
+	messages := make([]string, 0, len(e.Chunks))
+	for _, chunk := range e.Chunks {
+		messages = append(messages, fmt.Sprintf("%d points from %s: %s", len(chunk.Pids), chunk.Pids[0], chunk.Err))
+	}
+	return fmt.Sprintf("failed to get values of %d requests: %s", len(e.Chunks), strings.Join(messages, "; "))
+}
+
+// GetValues fetches the values of the given points. They are fetched in requests of at most
+// MaxPointsPerRequest points, of which at most MaxConcurrentRequests are in flight at once.
+// If only some of the requests fail, the values of the others are returned along with a *PartialValuesError.
 func (bastecClient *BastecClient) GetValues(values []string) (response *ValuesResponse, err error) {
+	return bastecClient.GetValuesContext(context.Background(), values)
+}
+
+// GetValuesContext is GetValues, giving up on the requests when ctx is done.
+func (bastecClient *BastecClient) GetValuesContext(ctx context.Context, values []string) (response *ValuesResponse, err error) {
+	if len(values) == 0 {
+		// Nothing to ask the DUC for
+		return &ValuesResponse{}, nil
+	}
+	chunks := chunkPids(values, bastecClient.MaxPointsPerRequest)
+	if len(chunks) <= 1 {
+		return bastecClient.getValues(ctx, values)
+	}
+
+	responses := make([]*ValuesResponse, len(chunks))
+	errs := make([]error, len(chunks))
+	inFlight := make(chan struct{}, max(bastecClient.MaxConcurrentRequests, 1))
+	var wg sync.WaitGroup
+	for i, chunk := range chunks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case inFlight <- struct{}{}:
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				return
+			}
+			defer func() { <-inFlight }()
+			responses[i], errs[i] = bastecClient.getValues(ctx, chunk)
+		}()
+	}
+	wg.Wait()
+
+	var partialErr PartialValuesError
+	for i, chunkResponse := range responses {
+		if errs[i] != nil {
+			partialErr.Chunks = append(partialErr.Chunks, ChunkError{Pids: chunks[i], Err: errs[i]})
+			continue
+		}
+		if response == nil {
+			response = chunkResponse
+			continue
+		}
+		response.Result.Points = append(response.Result.Points, chunkResponse.Result.Points...)
+		if chunkResponse.Result.Timet > response.Result.Timet {
+			response.Result.Timet = chunkResponse.Result.Timet
+			response.Result.Times = chunkResponse.Result.Times
+		}
+	}
+	if response == nil {
+		return nil, eris.Wrapf(errs[0], "all %d GetValues requests failed", len(chunks))
+	}
+	if len(partialErr.Chunks) > 0 {
+		err = &partialErr
+	}
+	return
+}
+
+// chunkPids splits the pids into chunks of at most size pids. A size of 0 or less means no limit.
+func chunkPids(pids []string, size int) [][]string {
+	if size <= 0 || len(pids) <= size {
+		return [][]string{pids}
+	}
+	var chunks [][]string
+	for start := 0; start < len(pids); start += size {
+		chunks = append(chunks, pids[start:min(start+size, len(pids))])
+	}
+	return chunks
+}
+
+func (bastecClient *BastecClient) getValues(ctx context.Context, values []string) (response *ValuesResponse, err error) {
 
 	params := [][]string{values}
 
@@ -35,7 +132,7 @@ func (bastecClient *BastecClient) GetValues(values []string) (response *ValuesRe
 		Params:         params,
 	}
 
-	jsonResponse, err := bastecClient.jsonRpc(rpcRequest)
+	jsonResponse, err := bastecClient.jsonRpc(ctx, rpcRequest)
 	if err != nil {
 		return nil, eris.Wrapf(err, "failed GetValues jsonRpc request")
 	}
@@ -44,8 +141,6 @@ func (bastecClient *BastecClient) GetValues(values []string) (response *ValuesRe
 	if err != nil {
 		return
 	}
-	if response.Error != "" {
-		err = errors.New(fmt.Sprintf("getValues error: %s", response.Error))
-	}
+	err = rpcError(rpcRequest.Method, response.Error)
 	return
 }
@@ -3,7 +3,6 @@ package bastec
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
 	"net/http"
 	"net/url"
@@ -21,23 +20,28 @@ type Session struct {
 	City    string `json:"city"`
 }
 
-func login(requesterURL url.URL, password string, saltResponse Salts) (sessionId string, err error) {
+func login(httpClient *http.Client, requesterURL url.URL, password string, saltResponse Salts) (sessionId string, session Session, err error) {
 	hash := generateBastecHash(password, saltResponse)
 
 	loginUrl := requesterURL
 	x := requesterURL.Query()
 	x.Add("hash", hash)
 	loginUrl.RawQuery = x.Encode()
-	loginResponse, err := http.Get(loginUrl.String())
+	loginResponse, err := httpClient.Get(loginUrl.String())
 	logger().Trace().Msgf("loginUrl: %s", loginUrl.String())
 	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = redactedUrl(&loginUrl)
+		}
 		return
 	}
+	defer closeBody(loginResponse)
 
 	if loginResponse.StatusCode != 200 {
 		loginBody, _ := io.ReadAll(loginResponse.Body)
 		logger().Debug().Msgf("login response (status = %s) failed with body: %s", loginResponse.Status, string(loginBody))
-		err = errors.New(fmt.Sprintf("http error code %d", loginResponse.StatusCode))
+		err = newHTTPStatusError(loginResponse)
 		return
 	}
 
@@ -48,14 +52,14 @@ func login(requesterURL url.URL, password string, saltResponse Salts) (sessionId
 
 	logger().Trace().Msgf("login response body: %s", string(loginBody))
 
-	var session Session
 	err = json.Unmarshal(loginBody, &session)
 	if err != nil {
 		return
 	}
 
 	if session.UserId == "" {
-		err = errors.New(fmt.Sprintf("login failed, no user found: %s", string(loginBody)))
+		logger().Debug().Msgf("login failed, no user found: %s", string(loginBody))
+		err = ErrWrongPassword
 		return
 	}
 
@@ -74,16 +78,17 @@ func login(requesterURL url.URL, password string, saltResponse Salts) (sessionId
 	return
 }
 
-func getSalts(requesterURL url.URL) (saltResponse Salts, err error) {
-	res, err := http.Get(requesterURL.String())
+func getSalts(httpClient *http.Client, requesterURL url.URL) (saltResponse Salts, err error) {
+	res, err := httpClient.Get(requesterURL.String())
 	if err != nil {
 		return
 	}
+	defer closeBody(res)
 
 	if res.StatusCode != 200 {
 		loginBody, _ := io.ReadAll(res.Body)
 		logger().Debug().Msgf("login response (status = %s) failed with body: %s", res.Status, string(loginBody))
-		err = errors.New(fmt.Sprintf("http error code %d", res.StatusCode))
+		err = newHTTPStatusError(res)
 		return
 	}
 	body, err := io.ReadAll(res.Body)
@@ -95,5 +100,9 @@ func getSalts(requesterURL url.URL) (saltResponse Salts, err error) {
 	if err != nil {
 		return
 	}
+	if len(saltResponse.SaltA) == 0 || len(saltResponse.SaltB) == 0 {
+		logger().Debug().Msgf("no salts in login response: %s", string(body))
+		err = ErrUnknownUser
+	}
 	return
 }
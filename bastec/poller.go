@@ -0,0 +1,348 @@
+package bastec
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+// reloginAfterErrors is how many polls in a row may fail before the Poller logs in to the DUC again,
+// in case it restarted and forgot the session without saying so.
+const reloginAfterErrors = 3
+
+// PointUpdate is a polled value of a point.
+type PointUpdate struct {
+	Pid           string
+	Value         float64
+	Decimals      int
+	DecimalsShown int
+	// Time is the DUC's time of the value.
+	Time time.Time
+}
+
+// PollResult is the outcome of polling a group of points that are polled at the same interval.
+type PollResult struct {
+	Interval time.Duration
+	Pids     []string
+	// Time is the DUC's time of the values.
+	Time     time.Time
+	Points   []Point
+	Duration time.Duration
+	// Err is set if the poll failed. If it's a *PartialValuesError, Points holds the values that could be fetched.
+	Err error
+}
+
+// pollGroup is the points that are polled together in a single request.
+type pollGroup struct {
+	interval time.Duration
+	pids     []string
+	// next is when the group is due. It's advanced by whole intervals, so that slow polls don't make it drift.
+	next time.Time
+}
+
+// Poller polls points of the DUC on a schedule and hands out the values as they come in,
+// through Updates, OnUpdate and OnPoll. Points can be polled at different intervals, and the points
+// of each interval are polled together. Set everything up before calling Run.
+type Poller struct {
+	client          *BastecClient
+	defaultInterval time.Duration
+	// Registry, if set, gets all polled values merged into it.
+	Registry *PointRegistry
+
+	onUpdate []func(update PointUpdate)
+	onPoll   []func(result PollResult)
+	onTick   []func()
+	updates  chan PointUpdate
+
+	mutex sync.Mutex
+	// pids and intervals are the points to poll, as last set with SetPoints.
+	pids      []string
+	intervals map[string]time.Duration
+	changed   chan struct{}
+	pollNow   chan struct{}
+
+	// groups are sorted fastest first, so that fast points are polled first when several groups are due.
+	// Intervals without any points have no group.
+	groups            []*pollGroup
+	consecutiveErrors int
+}
+
+// NewPoller creates a poller that polls points at defaultInterval unless SetPoints says otherwise.
+func NewPoller(client *BastecClient, defaultInterval time.Duration) *Poller {
+	return &Poller{
+		client:          client,
+		defaultInterval: defaultInterval,
+		changed:         make(chan struct{}, 1),
+		pollNow:         make(chan struct{}, 1),
+	}
+}
+
+// SetPoints replaces the points to poll. intervalOf returns how often to poll a point, or 0 for the default
+// interval. All points are polled right away, and from then on at their intervals.
+func (poller *Poller) SetPoints(pids []string, intervalOf func(pid string) time.Duration) {
+	intervals := make(map[string]time.Duration, len(pids))
+	for _, pid := range pids {
+		interval := time.Duration(0)
+		if intervalOf != nil {
+			interval = intervalOf(pid)
+		}
+		if interval <= 0 {
+			interval = poller.defaultInterval
+		}
+		intervals[pid] = interval
+	}
+	poller.mutex.Lock()
+	poller.pids = pids
+	poller.intervals = intervals
+	poller.mutex.Unlock()
+	notify(poller.changed)
+}
+
+// PollNow polls all points right away, without waiting for their intervals.
+func (poller *Poller) PollNow() {
+	notify(poller.pollNow)
+}
+
+// Updates returns a channel that receives every polled value. It must be drained, or polling stops
+// until it is. It's closed when Run returns.
+func (poller *Poller) Updates() <-chan PointUpdate {
+	poller.mutex.Lock()
+	defer poller.mutex.Unlock()
+	if poller.updates == nil {
+		poller.updates = make(chan PointUpdate, 256)
+	}
+	return poller.updates
+}
+
+// OnUpdate registers a callback that is called with every polled value, from the polling goroutine.
+func (poller *Poller) OnUpdate(callback func(update PointUpdate)) {
+	poller.onUpdate = append(poller.onUpdate, callback)
+}
+
+// OnPoll registers a callback that is called after every poll of a group of points, whether it failed or not,
+// from the polling goroutine.
+func (poller *Poller) OnPoll(callback func(result PollResult)) {
+	poller.onPoll = append(poller.onPoll, callback)
+}
+
+// OnTick registers a callback that is called at least every default interval while Run is running, whether
+// anything was polled or not, e.g. to tell a watchdog that polling is alive. It's called from the polling goroutine.
+func (poller *Poller) OnTick(callback func()) {
+	poller.onTick = append(poller.onTick, callback)
+}
+
+// ShortestInterval is the longest Run goes without polling anything or calling the OnTick callbacks.
+func (poller *Poller) ShortestInterval() time.Duration {
+	poller.mutex.Lock()
+	defer poller.mutex.Unlock()
+	shortest := poller.defaultInterval
+	for _, interval := range poller.intervals {
+		shortest = min(shortest, interval)
+	}
+	return shortest
+}
+
+// ShortestPolledInterval is the shortest interval any point is polled at, i.e. the longest Run goes without
+// polling anything as long as there are points. It's 0 without any points.
+func (poller *Poller) ShortestPolledInterval() time.Duration {
+	poller.mutex.Lock()
+	defer poller.mutex.Unlock()
+	var shortest time.Duration
+	for _, interval := range poller.intervals {
+		if shortest == 0 || interval < shortest {
+			shortest = interval
+		}
+	}
+	return shortest
+}
+
+// Run polls until the context is cancelled.
+func (poller *Poller) Run(ctx context.Context) error {
+	defer func() {
+		poller.mutex.Lock()
+		defer poller.mutex.Unlock()
+		if poller.updates != nil {
+			close(poller.updates)
+		}
+	}()
+	// The points set before Run are scheduled right away
+	select {
+	case <-poller.changed:
+	default:
+	}
+	poller.reschedule(time.Now())
+	nextTick := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		pollAll := false
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		case <-poller.pollNow:
+			pollAll = true
+		case <-poller.changed:
+			poller.reschedule(time.Now())
+		}
+
+		now := time.Now()
+		for _, group := range poller.due(now, pollAll) {
+			if err := poller.poll(ctx, group); err != nil {
+				return err
+			}
+		}
+		if !now.Before(nextTick) {
+			for _, callback := range poller.onTick {
+				callback()
+			}
+			nextTick = now.Add(poller.defaultInterval)
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(time.Until(poller.nextDue(nextTick)))
+	}
+}
+
+// reschedule groups the points by their interval. All groups are due right away.
+func (poller *Poller) reschedule(now time.Time) {
+	poller.mutex.Lock()
+	defer poller.mutex.Unlock()
+	groupsByInterval := map[time.Duration]*pollGroup{}
+	for _, pid := range poller.pids {
+		interval := poller.intervals[pid]
+		group := groupsByInterval[interval]
+		if group == nil {
+			group = &pollGroup{interval: interval, next: now}
+			groupsByInterval[interval] = group
+		}
+		group.pids = append(group.pids, pid)
+	}
+
+	poller.groups = poller.groups[:0]
+	for _, group := range groupsByInterval {
+		poller.groups = append(poller.groups, group)
+		logger().Debug().Msgf("Polling %d points every %s", len(group.pids), group.interval)
+	}
+	slices.SortFunc(poller.groups, func(a, b *pollGroup) int {
+		return cmp.Compare(a.interval, b.interval)
+	})
+}
+
+// nextDue is when the next group is due, or nextTick if that's sooner.
+func (poller *Poller) nextDue(nextTick time.Time) time.Time {
+	next := nextTick
+	for _, group := range poller.groups {
+		if group.next.Before(next) {
+			next = group.next
+		}
+	}
+	return next
+}
+
+// due returns the groups that are due, fastest first, and schedules them for their next interval.
+// If all is set, every group is returned.
+func (poller *Poller) due(now time.Time, all bool) []*pollGroup {
+	var due []*pollGroup
+	for _, group := range poller.groups {
+		if !all && group.next.After(now) {
+			continue
+		}
+		due = append(due, group)
+		if !group.next.After(now) {
+			// Skip the ticks that were missed rather than polling several times in a row
+			missed := now.Sub(group.next) / group.interval
+			group.next = group.next.Add((missed + 1) * group.interval)
+		}
+	}
+	return due
+}
+
+// poll fetches the values of a group and hands them out. It only returns an error if the context was
+// cancelled.
+func (poller *Poller) poll(ctx context.Context, group *pollGroup) error {
+	pollStart := time.Now()
+	values, err := poller.client.GetValuesContext(ctx, group.pids)
+	if ctx.Err() != nil {
+		// Cancelled, not a failure of the DUC
+		return ctx.Err()
+	}
+	result := PollResult{
+		Interval: group.interval,
+		Pids:     group.pids,
+		Time:     time.Now(),
+		Duration: time.Since(pollStart),
+		Err:      err,
+	}
+	if values != nil {
+		result.Points = values.Result.Points
+		if values.Result.Timet != 0 {
+			result.Time = time.Unix(values.Result.Timet, 0)
+		}
+	}
+	poller.checkConnection(err)
+
+	if values != nil && poller.Registry != nil {
+		poller.Registry.MergeValues(values)
+	}
+	for _, callback := range poller.onPoll {
+		callback(result)
+	}
+	poller.mutex.Lock()
+	updates := poller.updates
+	poller.mutex.Unlock()
+	for _, point := range result.Points {
+		update := PointUpdate{
+			Pid:           point.Pid,
+			Value:         point.Value,
+			Decimals:      point.Decimals,
+			DecimalsShown: point.DecimalsShown,
+			Time:          result.Time,
+		}
+		for _, callback := range poller.onUpdate {
+			callback(update)
+		}
+		if updates != nil {
+			select {
+			case updates <- update:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return nil
+}
+
+// checkConnection logs in to the DUC again when polls keep failing for other reasons than the DUC
+// rejecting the request itself. Expired sessions are already handled by the client.
+func (poller *Poller) checkConnection(err error) {
+	var partialErr *PartialValuesError
+	var rpcErr *RPCError
+	if err == nil || errors.As(err, &partialErr) || errors.As(err, &rpcErr) {
+		poller.consecutiveErrors = 0
+		return
+	}
+	poller.consecutiveErrors++
+	if poller.consecutiveErrors%reloginAfterErrors != 0 {
+		return
+	}
+	logger().Warn().Err(err).Msgf("%d polls in a row failed, logging in to the DUC again", poller.consecutiveErrors)
+	if err := poller.client.Relogin(); err != nil {
+		logger().Error().Err(err).Msg("Failed to log in to the DUC again")
+	}
+}
+
+func notify(channel chan struct{}) {
+	select {
+	case channel <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,191 @@
+package bastec
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// runPoller runs the poller for a while and returns how often it ticked.
+func runPoller(t *testing.T, poller *Poller, duration time.Duration) int64 {
+	t.Helper()
+	var ticks atomic.Int64
+	poller.OnTick(func() { ticks.Add(1) })
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+	if err := poller.Run(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("poller failed: %v", err)
+	}
+	return ticks.Load()
+}
+
+func TestPollerWithoutPointsOnlyTicks(t *testing.T) {
+	duc := newFakeDuc(t)
+	client := newTestClient(t, duc)
+	poller := NewPoller(client, 20*time.Millisecond)
+	poller.OnPoll(func(result PollResult) {
+		t.Errorf("polled %d pids without any points", len(result.Pids))
+	})
+
+	ticks := runPoller(t, poller, 200*time.Millisecond)
+	if _, requests, _ := duc.stats(); requests != 0 {
+		t.Errorf("sent %d requests to the DUC without any points", requests)
+	}
+	if ticks < 3 {
+		t.Errorf("ticked %d times in 10 intervals", ticks)
+	}
+}
+
+func TestPollerDoesNotPollTheDefaultIntervalWithoutPoints(t *testing.T) {
+	duc := newFakeDuc(t)
+	client := newTestClient(t, duc)
+	poller := NewPoller(client, 20*time.Millisecond)
+	poller.SetPoints([]string{"1.ai.1", "1.ai.2"}, func(pid string) time.Duration { return time.Hour })
+	var polls atomic.Int64
+	poller.OnPoll(func(result PollResult) {
+		polls.Add(1)
+		if result.Interval != time.Hour || len(result.Pids) != 2 {
+			t.Errorf("polled %d pids every %s, expected the 2 pids every hour", len(result.Pids), result.Interval)
+		}
+	})
+
+	ticks := runPoller(t, poller, 200*time.Millisecond)
+	if polls.Load() != 1 {
+		t.Errorf("polled %d times, expected only the first poll of the hourly points", polls.Load())
+	}
+	if ticks < 3 {
+		t.Errorf("ticked %d times in 10 intervals", ticks)
+	}
+}
+
+func TestGetValuesWithoutPids(t *testing.T) {
+	duc := newFakeDuc(t)
+	client := newTestClient(t, duc)
+	values, err := client.GetValues(nil)
+	if err != nil || len(values.Result.Points) != 0 {
+		t.Errorf("got %v and %d values without any pids", err, len(values.Result.Points))
+	}
+	if _, requests, _ := duc.stats(); requests != 0 {
+		t.Errorf("sent %d requests to the DUC without any pids", requests)
+	}
+}
+
+func TestShortestPolledIntervalOnlyCountsPolledPoints(t *testing.T) {
+	poller := NewPoller(nil, 10*time.Second)
+	if interval := poller.ShortestPolledInterval(); interval != 0 {
+		t.Errorf("got %s without any points, expected 0", interval)
+	}
+	intervals := map[string]time.Duration{"1.em.1": 5 * time.Minute, "1.em.2": time.Minute}
+	poller.SetPoints([]string{"1.em.1", "1.em.2"}, func(pid string) time.Duration { return intervals[pid] })
+	if interval := poller.ShortestPolledInterval(); interval != time.Minute {
+		t.Errorf("got %s, expected the minute of the points polled most often", interval)
+	}
+	if interval := poller.ShortestInterval(); interval != 10*time.Second {
+		t.Errorf("got %s as the shortest interval, expected the default interval", interval)
+	}
+}
+
+func TestPollerHandsOutUpdates(t *testing.T) {
+	duc := newFakeDuc(t)
+	poller := NewPoller(newTestClient(t, duc), time.Hour)
+	pids := []string{"1.ai.1", "1.ai.2", "1.ai.3"}
+	poller.SetPoints(pids, nil)
+	var mutex sync.Mutex
+	var onUpdate []PointUpdate
+	poller.OnUpdate(func(update PointUpdate) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		onUpdate = append(onUpdate, update)
+	})
+	updates := poller.Updates()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	received := make(chan []PointUpdate)
+	go func() {
+		var updatesReceived []PointUpdate
+		for update := range updates {
+			updatesReceived = append(updatesReceived, update)
+			if len(updatesReceived) == len(pids) {
+				cancel()
+			}
+		}
+		// Only reached once Run has closed the channel
+		received <- updatesReceived
+	}()
+	if err := poller.Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("poller failed: %v", err)
+	}
+
+	var updatesReceived []PointUpdate
+	select {
+	case updatesReceived = <-received:
+	case <-time.After(time.Second):
+		t.Fatal("the updates channel wasn't closed when Run returned")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	for name, got := range map[string][]PointUpdate{"Updates": updatesReceived, "OnUpdate": onUpdate} {
+		if len(got) != len(pids) {
+			t.Fatalf("got %d updates through %s, expected %d", len(got), name, len(pids))
+		}
+		for i, update := range got {
+			if update.Pid != pids[i] || update.Value != float64(i) || update.Decimals != 1 || update.Time.IsZero() {
+				t.Errorf("got %+v through %s, expected %s with the value %d", update, name, pids[i], i)
+			}
+		}
+	}
+}
+
+func TestPollerCanBeCancelledDuringAPoll(t *testing.T) {
+	duc := newFakeDuc(t)
+	poller := NewPoller(newTestClient(t, duc), time.Hour)
+	poller.SetPoints([]string{"1.ai.1"}, nil)
+	poller.OnPoll(func(result PollResult) {
+		t.Errorf("a cancelled poll was handed out with the error %v", result.Err)
+	})
+	duc.answerWith(time.Minute, false)
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := poller.Run(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("poller failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %s to stop polling, expected it to give up on the request", elapsed)
+	}
+}
+
+func TestPollerLogsInAgainAfterFailedPolls(t *testing.T) {
+	duc := newFakeDuc(t)
+	poller := NewPoller(newTestClient(t, duc), 10*time.Millisecond)
+	poller.SetPoints([]string{"1.ai.1"}, nil)
+	duc.answerWith(0, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var loginsAfterPolls []int
+	poller.OnPoll(func(result PollResult) {
+		if result.Err == nil {
+			t.Error("a poll succeeded while the DUC failed")
+		}
+		logins, _, _ := duc.stats()
+		loginsAfterPolls = append(loginsAfterPolls, logins)
+		if len(loginsAfterPolls) == reloginAfterErrors {
+			cancel()
+		}
+	})
+	if err := poller.Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("poller failed: %v", err)
+	}
+
+	expected := []int{1, 1, 2}
+	if !slices.Equal(loginsAfterPolls, expected) {
+		t.Errorf("logged in %v times after each failed poll, expected %v", loginsAfterPolls, expected)
+	}
+}
@@ -0,0 +1,269 @@
+package bastec
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// PointType is the kind of value of a point, as reported by pdb.browse.
+type PointType string
+
+const (
+	PointTypeNumber PointType = "number"
+	PointTypeEnum   PointType = "enum"
+)
+
+// AccessMode is whether a point can be read and/or written, as reported in PointConfig.Acc.
+type AccessMode uint8
+
+const (
+	AccessRead AccessMode = 1 << iota
+	AccessWrite
+)
+
+// ParseAccessMode parses the access of a point, e.g. "r" or "rw".
+func ParseAccessMode(acc string) (mode AccessMode) {
+	if strings.Contains(acc, "r") {
+		mode |= AccessRead
+	}
+	if strings.Contains(acc, "w") {
+		mode |= AccessWrite
+	}
+	return
+}
+
+func (mode AccessMode) CanRead() bool {
+	return mode&AccessRead != 0
+}
+
+func (mode AccessMode) CanWrite() bool {
+	return mode&AccessWrite != 0
+}
+
+// RegisteredPoint is a point on the DUC with its latest value, if any has been merged into the registry.
+type RegisteredPoint struct {
+	Pid    string
+	Desc   string
+	Type   PointType
+	Access AccessMode
+	Unit   string
+
+	HasValue      bool
+	Value         float64
+	Decimals      int
+	DecimalsShown int
+	// Time is the DUC's time of the value.
+	Time time.Time
+}
+
+// prefixNode is a node in the tree of pid prefixes, where each level is one dot separated part of the pid.
+type prefixNode struct {
+	children map[string]*prefixNode
+	// pids are the points at or below the node, in the order the DUC reported them.
+	pids []string
+}
+
+func newPrefixNode() *prefixNode {
+	return &prefixNode{children: map[string]*prefixNode{}}
+}
+
+// PointRegistry keeps track of the points on the DUC and their latest values. It's safe for concurrent use.
+type PointRegistry struct {
+	mutex     sync.RWMutex
+	devId     string
+	points    map[string]*RegisteredPoint
+	root      *prefixNode
+	callbacks []func(point RegisteredPoint, previous RegisteredPoint)
+}
+
+// NewPointRegistry creates a registry of the points of a browse response.
+func NewPointRegistry(browse *BrowseResponse) *PointRegistry {
+	registry := &PointRegistry{}
+	registry.SetPoints(browse.Result.DevId, browse.Result.Points)
+	return registry
+}
+
+// BrowseRegistry browses the DUC and creates a registry of its points.
+func (bastecClient *BastecClient) BrowseRegistry() (*PointRegistry, error) {
+	browse, err := bastecClient.Browse()
+	if err != nil {
+		return nil, err
+	}
+	return NewPointRegistry(browse), nil
+}
+
+// SetPoints replaces the points in the registry, e.g. after browsing the DUC again.
+// The values of points that are still there are kept.
+func (registry *PointRegistry) SetPoints(devId string, points []PointConfig) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registeredPoints := make(map[string]*RegisteredPoint, len(points))
+	root := newPrefixNode()
+	for _, point := range points {
+		registeredPoint := &RegisteredPoint{
+			Pid:    point.Pid,
+			Desc:   point.Desc,
+			Type:   PointType(point.Type),
+			Access: ParseAccessMode(point.Acc),
+			Unit:   point.Attr,
+		}
+		if previous, found := registry.points[point.Pid]; found {
+			registeredPoint.HasValue = previous.HasValue
+			registeredPoint.Value = previous.Value
+			registeredPoint.Decimals = previous.Decimals
+			registeredPoint.DecimalsShown = previous.DecimalsShown
+			registeredPoint.Time = previous.Time
+		}
+		registeredPoints[point.Pid] = registeredPoint
+
+		node := root
+		node.pids = append(node.pids, point.Pid)
+		for _, part := range strings.Split(point.Pid, ".") {
+			child := node.children[part]
+			if child == nil {
+				child = newPrefixNode()
+				node.children[part] = child
+			}
+			child.pids = append(child.pids, point.Pid)
+			node = child
+		}
+	}
+	registry.devId = devId
+	registry.points = registeredPoints
+	registry.root = root
+}
+
+// DevId is the id of the DUC the points are on.
+func (registry *PointRegistry) DevId() string {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	return registry.devId
+}
+
+// Point returns a point by its pid.
+func (registry *PointRegistry) Point(pid string) (point RegisteredPoint, found bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	if registeredPoint, found := registry.points[pid]; found {
+		return *registeredPoint, true
+	}
+	return
+}
+
+// Points returns all points, in the order the DUC reported them.
+func (registry *PointRegistry) Points() []RegisteredPoint {
+	return registry.WithPrefix("")
+}
+
+// WithPrefix returns the points whose pids start with the given dot separated parts, e.g. "1.ai" or "1.ai."
+// returns 1.ai.1 and 1.ai.2 but not 1.aix.1. An empty prefix returns all points.
+func (registry *PointRegistry) WithPrefix(prefix string) []RegisteredPoint {
+	prefix = strings.TrimSuffix(prefix, ".")
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	node := registry.node(prefix)
+	if node == nil {
+		return nil
+	}
+	points := make([]RegisteredPoint, 0, len(node.pids))
+	for _, pid := range node.pids {
+		points = append(points, *registry.points[pid])
+	}
+	return points
+}
+
+// Children returns the prefixes directly below a prefix, e.g. "1.ai" and "1.em" below "1" or "1.", in the
+// order the DUC reported their first points.
+func (registry *PointRegistry) Children(prefix string) []string {
+	prefix = strings.TrimSuffix(prefix, ".")
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	node := registry.node(prefix)
+	if node == nil {
+		return nil
+	}
+	depth := 0
+	if prefix != "" {
+		depth = strings.Count(prefix, ".") + 1
+	}
+	// Keep the order the DUC reported the points in
+	var children []string
+	seen := map[string]bool{}
+	for _, pid := range node.pids {
+		parts := strings.Split(pid, ".")
+		if depth >= len(parts) {
+			continue
+		}
+		child := strings.Join(parts[:depth+1], ".")
+		if !seen[child] {
+			seen[child] = true
+			children = append(children, child)
+		}
+	}
+	return children
+}
+
+// node returns the node of a prefix without a trailing dot. Must be called with the mutex held.
+func (registry *PointRegistry) node(prefix string) *prefixNode {
+	node := registry.root
+	if node == nil || prefix == "" {
+		return node
+	}
+	for _, part := range strings.Split(prefix, ".") {
+		if node = node.children[part]; node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+// OnChange registers a callback that is called with every point whose value changes when values are merged,
+// including the first value of a point. It's called after the registry is updated, from the merging goroutine.
+func (registry *PointRegistry) OnChange(callback func(point RegisteredPoint, previous RegisteredPoint)) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.callbacks = append(registry.callbacks, callback)
+}
+
+// MergeValues stores the values of a GetValues response, timestamped with the DUC's time of the response.
+// Values of points that aren't in the registry are ignored. It returns the points whose values changed.
+func (registry *PointRegistry) MergeValues(values *ValuesResponse) []RegisteredPoint {
+	timestamp := time.Now()
+	if values.Result.Timet != 0 {
+		timestamp = time.Unix(values.Result.Timet, 0)
+	}
+
+	type change struct {
+		point    RegisteredPoint
+		previous RegisteredPoint
+	}
+	var changes []change
+	registry.mutex.Lock()
+	for _, value := range values.Result.Points {
+		registeredPoint, found := registry.points[value.Pid]
+		if !found {
+			continue
+		}
+		previous := *registeredPoint
+		registeredPoint.HasValue = true
+		registeredPoint.Value = value.Value
+		registeredPoint.Decimals = value.Decimals
+		registeredPoint.DecimalsShown = value.DecimalsShown
+		registeredPoint.Time = timestamp
+		if !previous.HasValue || previous.Value != value.Value {
+			changes = append(changes, change{point: *registeredPoint, previous: previous})
+		}
+	}
+	callbacks := registry.callbacks
+	registry.mutex.Unlock()
+
+	changed := make([]RegisteredPoint, 0, len(changes))
+	for _, change := range changes {
+		changed = append(changed, change.point)
+		for _, callback := range callbacks {
+			callback(change.point, change.previous)
+		}
+	}
+	return changed
+}
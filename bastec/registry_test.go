@@ -0,0 +1,114 @@
+package bastec
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func newTestRegistry() *PointRegistry {
+	var browse BrowseResponse
+	browse.Result.DevId = "DUC-1234"
+	browse.Result.Points = []PointConfig{
+		{Pid: "1.em.1", Desc: "Energy total", Acc: "r", Type: "number", Attr: "kWh"},
+		{Pid: "1.ai.1", Desc: "Outdoor temperature", Acc: "r", Type: "number", Attr: "°C"},
+		{Pid: "2.sp.1", Desc: "Setpoint", Acc: "rw", Type: "number", Attr: "°C"},
+		{Pid: "1.aix.1", Desc: "Extra input", Acc: "r", Type: "number"},
+		{Pid: "1.ai.2", Desc: "Supply air", Acc: "r", Type: "number", Attr: "°C"},
+	}
+	return NewPointRegistry(&browse)
+}
+
+func pidsOf(points []RegisteredPoint) (pids []string) {
+	for _, point := range points {
+		pids = append(pids, point.Pid)
+	}
+	return
+}
+
+func TestRegistryWithPrefix(t *testing.T) {
+	registry := newTestRegistry()
+	for prefix, expected := range map[string][]string{
+		"":       {"1.em.1", "1.ai.1", "2.sp.1", "1.aix.1", "1.ai.2"},
+		"1":      {"1.em.1", "1.ai.1", "1.aix.1", "1.ai.2"},
+		"1.ai":   {"1.ai.1", "1.ai.2"},
+		"1.ai.":  {"1.ai.1", "1.ai.2"},
+		"1.ai.2": {"1.ai.2"},
+		"1.a":    nil,
+		"3.":     nil,
+	} {
+		if pids := pidsOf(registry.WithPrefix(prefix)); !slices.Equal(pids, expected) {
+			t.Errorf("got %v with the prefix %q, expected %v", pids, prefix, expected)
+		}
+	}
+
+	point, found := registry.Point("2.sp.1")
+	if !found || point.Type != PointTypeNumber || !point.Access.CanWrite() || point.Unit != "°C" || point.HasValue {
+		t.Errorf("got %+v for 2.sp.1", point)
+	}
+}
+
+func TestRegistryChildrenKeepTheOrderOfTheDuc(t *testing.T) {
+	registry := newTestRegistry()
+	for prefix, expected := range map[string][]string{
+		"":       {"1", "2"},
+		"1":      {"1.em", "1.ai", "1.aix"},
+		"1.":     {"1.em", "1.ai", "1.aix"},
+		"1.ai.":  {"1.ai.1", "1.ai.2"},
+		"1.ai.1": nil,
+		"3":      nil,
+	} {
+		if children := registry.Children(prefix); !slices.Equal(children, expected) {
+			t.Errorf("got the children %v of %q, expected %v", children, prefix, expected)
+		}
+	}
+}
+
+func TestRegistryMergeValuesCallsOnChange(t *testing.T) {
+	registry := newTestRegistry()
+	type change struct {
+		pid      string
+		value    float64
+		previous RegisteredPoint
+	}
+	var changes []change
+	registry.OnChange(func(point RegisteredPoint, previous RegisteredPoint) {
+		changes = append(changes, change{pid: point.Pid, value: point.Value, previous: previous})
+	})
+	merge := func(timet int64, points ...Point) []RegisteredPoint {
+		changes = nil
+		var values ValuesResponse
+		values.Result.Timet = timet
+		values.Result.Points = points
+		return registry.MergeValues(&values)
+	}
+
+	changed := merge(1000, Point{Pid: "1.ai.1", Value: 12.5, Decimals: 1}, Point{Pid: "9.xx.1", Value: 1})
+	if pids := pidsOf(changed); !slices.Equal(pids, []string{"1.ai.1"}) {
+		t.Errorf("got the changed points %v, expected the first value of 1.ai.1 and no unknown points", pids)
+	}
+	if len(changes) != 1 || changes[0].previous.HasValue {
+		t.Errorf("got the changes %+v, expected 1.ai.1 without a previous value", changes)
+	}
+	if point, _ := registry.Point("1.ai.1"); point.Value != 12.5 || !point.Time.Equal(time.Unix(1000, 0)) {
+		t.Errorf("got %+v, expected the value at the DUC's time", point)
+	}
+
+	if changed = merge(1010, Point{Pid: "1.ai.1", Value: 12.5, Decimals: 1}); len(changed) != 0 || len(changes) != 0 {
+		t.Errorf("got the changes %+v of an unchanged value", changes)
+	}
+	if point, _ := registry.Point("1.ai.1"); !point.Time.Equal(time.Unix(1010, 0)) {
+		t.Errorf("the time of an unchanged value wasn't updated: %s", point.Time)
+	}
+
+	merge(1020, Point{Pid: "1.ai.1", Value: 13, Decimals: 1})
+	if len(changes) != 1 || changes[0].value != 13 || changes[0].previous.Value != 12.5 {
+		t.Errorf("got the changes %+v, expected 1.ai.1 to change from 12.5 to 13", changes)
+	}
+
+	// Values are kept when the DUC is browsed again
+	registry.SetPoints("DUC-1234", []PointConfig{{Pid: "1.ai.1", Type: "number"}})
+	if point, _ := registry.Point("1.ai.1"); point.Value != 13 {
+		t.Errorf("the value was lost when setting the points again: %+v", point)
+	}
+}
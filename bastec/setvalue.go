@@ -0,0 +1,38 @@
+package bastec
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/rotisserie/eris"
+	"strconv"
+)
+
+type SetValueResponse struct {
+	JsonRpc string    `json:"json-rpc"`
+	Error   *RPCError `json:"error"`
+	Id      int       `json:"id"`
+}
+
+// SetValue writes a new value to a writable point.
+func (bastecClient *BastecClient) SetValue(pid string, value float64) (err error) {
+	params := [][]string{{pid, strconv.FormatFloat(value, 'f', -1, 64)}}
+
+	var rpcRequest = JsonRpcRequest{
+		JsonRpcVersion: "2.0",
+		Method:         "pdb.setvalue",
+		Params:         params,
+	}
+
+	jsonResponse, err := bastecClient.jsonRpc(context.Background(), rpcRequest)
+	if err != nil {
+		return eris.Wrapf(err, "failed SetValue jsonRpc request")
+	}
+	logger().Debug().Msg(string(jsonResponse))
+	var response SetValueResponse
+	err = json.Unmarshal(jsonResponse, &response)
+	if err != nil {
+		return
+	}
+	err = rpcError(rpcRequest.Method, response.Error)
+	return
+}
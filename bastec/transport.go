@@ -0,0 +1,112 @@
+package bastec
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The DUC's web server is small, so only a couple of connections are kept open to it and reused for every request.
+const (
+	maxIdleConnsPerHost = 2
+	idleConnTimeout     = 60 * time.Second
+	requestTimeout      = 30 * time.Second
+)
+
+// TransportStats counts the requests and connections of a BastecClient, to tell whether connections are reused.
+type TransportStats struct {
+	Requests          int64 `json:"requests"`
+	ConnectionsOpened int64 `json:"connectionsOpened"`
+	ConnectionsReused int64 `json:"connectionsReused"`
+	// OpenConnections is how many connections are open right now, idle or not.
+	OpenConnections int64 `json:"openConnections"`
+}
+
+type transportCounters struct {
+	requests          atomic.Int64
+	connectionsOpened atomic.Int64
+	connectionsReused atomic.Int64
+	openConnections   atomic.Int64
+}
+
+// countedConn keeps track of when a connection is closed.
+type countedConn struct {
+	net.Conn
+	counters  *transportCounters
+	closeOnce sync.Once
+}
+
+func (conn *countedConn) Close() error {
+	conn.closeOnce.Do(func() {
+		conn.counters.openConnections.Add(-1)
+	})
+	return conn.Conn.Close()
+}
+
+// newHttpClient creates the http client of a BastecClient, with its own pool of connections to the DUC.
+func newHttpClient(counters *transportCounters) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			counters.connectionsOpened.Add(1)
+			counters.openConnections.Add(1)
+			return &countedConn{Conn: conn, counters: counters}, nil
+		},
+		MaxIdleConns:          maxIdleConnsPerHost,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		IdleConnTimeout:       idleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	return &http.Client{
+		Transport: &countingRoundTripper{transport: transport, counters: counters},
+		Timeout:   requestTimeout,
+	}
+}
+
+// countingRoundTripper counts the requests and whether they reused a connection.
+type countingRoundTripper struct {
+	transport http.RoundTripper
+	counters  *transportCounters
+}
+
+func (roundTripper *countingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	roundTripper.counters.requests.Add(1)
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				roundTripper.counters.connectionsReused.Add(1)
+			}
+		},
+	}
+	return roundTripper.transport.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
+
+// TransportStats returns how many requests the client has sent and how many connections it has opened.
+func (bastecClient *BastecClient) TransportStats() TransportStats {
+	return TransportStats{
+		Requests:          bastecClient.counters.requests.Load(),
+		ConnectionsOpened: bastecClient.counters.connectionsOpened.Load(),
+		ConnectionsReused: bastecClient.counters.connectionsReused.Load(),
+		OpenConnections:   bastecClient.counters.openConnections.Load(),
+	}
+}
+
+// closeBody reads what's left of a response body before closing it, so that the connection can be reused.
+func closeBody(res *http.Response) {
+	_, _ = io.Copy(io.Discard, res.Body)
+	_ = res.Body.Close()
+}
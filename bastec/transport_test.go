@@ -0,0 +1,82 @@
+package bastec
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openFds counts the open file descriptors of the process, or returns -1 where /proc isn't available.
+func openFds() int {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(fds)
+}
+
+// waitForOpenConnections waits for connections beyond the idle pool to be closed, which happens as they're returned.
+func waitForOpenConnections(client *BastecClient, limit int64) int64 {
+	deadline := time.Now().Add(time.Second)
+	for {
+		open := client.TransportStats().OpenConnections
+		if open <= limit || time.Now().After(deadline) {
+			return open
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnectionsStayBoundedUnderLoad(t *testing.T) {
+	if testing.Short() {
+		t.Skip("soak test")
+	}
+	duc := newFakeDuc(t)
+	client := newTestClient(t, duc)
+	pids := []string{"1.ai.1", "1.ai.2", "1.ai.3"}
+	fdsBefore := openFds()
+
+	for i := range 2000 {
+		if _, err := client.GetValues(pids); err != nil {
+			t.Fatalf("request %d failed: %v", i, err)
+		}
+	}
+	stats := client.TransportStats()
+	if stats.ConnectionsOpened > maxIdleConnsPerHost {
+		t.Errorf("opened %d connections for %d sequential requests, expected them to be reused", stats.ConnectionsOpened, stats.Requests)
+	}
+
+	const concurrency = 8
+	var wg sync.WaitGroup
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 250 {
+				if _, err := client.GetValues(pids); err != nil {
+					t.Error(err)
+					return
+				}
+				// Connections beyond the idle pool may still be closing when new ones are opened
+				if open := client.TransportStats().OpenConnections; open > concurrency+maxIdleConnsPerHost {
+					t.Errorf("%d connections open with %d requests in flight", open, concurrency)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if open := waitForOpenConnections(client, maxIdleConnsPerHost); open > maxIdleConnsPerHost {
+		t.Errorf("%d connections still open after the load, expected at most %d idle ones", open, maxIdleConnsPerHost)
+	}
+	if fdsBefore >= 0 {
+		// Both ends of the idle connections are in this process
+		if fdsAfter := openFds(); fdsAfter > fdsBefore+2*maxIdleConnsPerHost {
+			t.Errorf("%d file descriptors open after the load, %d before", fdsAfter, fdsBefore)
+		}
+	}
+	stats = client.TransportStats()
+	t.Logf("%d requests over %d connections, %d reused", stats.Requests, stats.ConnectionsOpened, stats.ConnectionsReused)
+}
@@ -0,0 +1,61 @@
+package bastec
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/rotisserie/eris"
+)
+
+// DucVersion is the firmware and hardware information reported by pdb.version.
+type DucVersion struct {
+	Version  string `json:"version"`
+	Build    string `json:"build,omitempty"`
+	Hardware string `json:"hw,omitempty"`
+	DevId    string `json:"devid,omitempty"`
+}
+
+type VersionResponse struct {
+	JsonRpc string     `json:"json-rpc"`
+	Result  DucVersion `json:"result"`
+	Error   *RPCError  `json:"error"`
+	Id      int        `json:"id"`
+}
+
+// UnmarshalJSON accepts both a version object and a plain version string.
+func (ducVersion *DucVersion) UnmarshalJSON(data []byte) error {
+	var version string
+	if err := json.Unmarshal(data, &version); err == nil {
+		*ducVersion = DucVersion{Version: version}
+		return nil
+	}
+	type plainDucVersion DucVersion
+	return json.Unmarshal(data, (*plainDucVersion)(ducVersion))
+}
+
+// Firmware is the version and build as a single string, e.g. "2.3.4 (567)".
+func (ducVersion DucVersion) Firmware() string {
+	if ducVersion.Build == "" {
+		return ducVersion.Version
+	}
+	return fmt.Sprintf("%s (%s)", ducVersion.Version, ducVersion.Build)
+}
+
+func (bastecClient *BastecClient) GetVersion() (response *VersionResponse, err error) {
+	var rpcRequest = JsonRpcRequest{
+		JsonRpcVersion: "2.0",
+		Method:         "pdb.version",
+	}
+
+	jsonResponse, err := bastecClient.jsonRpc(context.Background(), rpcRequest)
+	if err != nil {
+		return nil, eris.Wrap(err, "failed to execute GetVersion jsonRPC")
+	}
+	logger().Debug().Msg(string(jsonResponse))
+	err = json.Unmarshal(jsonResponse, &response)
+	if err != nil {
+		return nil, eris.Wrap(err, "failed to parse json")
+	}
+	err = rpcError(rpcRequest.Method, response.Error)
+	return
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/SourceForgery/duc2mqtt/bastec"
+	"github.com/rs/zerolog/log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bridge polls the DUC and hands the values to the sinks. The selection of polled
+// points can be changed while it's running.
+type bridge struct {
+	config     *Config
+	configFile string
+	ducClient  *bastec.BastecClient
+	sinks      *Sinks
+	notifier   *systemdNotifier
+	commands   chan string
+	poller     *bastec.Poller
+	// registry has every browsed point with its latest value, for the sinks that serve values on request.
+	registry *bastec.PointRegistry
+
+	mutex sync.RWMutex
+	// browsed is every point on the DUC that isn't disallowed.
+	browsed []bastec.PointConfig
+	// points are the polled points, with the configured overrides applied.
+	points []bastec.PointConfig
+	// lastSuccessfulPoll is when values were last fetched from the DUC.
+	lastSuccessfulPoll time.Time
+	lastPollError      error
+	lastPollDuration   time.Duration
+	consecutiveErrors  int
+	publishedPoints    int
+	// polledPoints is how many points the last successful poll of each interval returned.
+	polledPoints map[time.Duration]int
+
+	// devId, ducVersion and session describe the DUC, version the bridge itself.
+	devId      string
+	ducVersion bastec.DucVersion
+	session    bastec.Session
+	version    string
+	startTime  time.Time
+
+	// stateFile is where the last good browse is cached, see browseCache.
+	stateFile string
+	// decimalsShown is how many decimals the DUC shows of each point, learnt from the polled values.
+	decimalsShown map[string]int
+	// browseNeeded is set while the points come from the cache or browsing failed, so that the DUC is
+	// browsed again as soon as it answers, but not before nextBrowse.
+	browseNeeded bool
+	nextBrowse   time.Time
+	// browseBackoff is how long to wait after the last failed browse, doubled with each failure.
+	browseBackoff time.Duration
+}
+
+// maxBrowseBackoff is the longest the bridge waits before browsing again after a failure.
+const maxBrowseBackoff = 10 * time.Minute
+
+// Commands for the poll loop, e.g. from Home Assistant buttons.
+const (
+	commandPollNow      = "poll_now"
+	commandBrowse       = "rebrowse"
+	commandReconnectDuc = "reconnect_duc"
+	// commandReconcile browses the DUC and fetches its version when it answers again, to replace what was cached.
+	commandReconcile = "reconcile"
+)
+
+// bridgeDiagnostics is the state of the bridge itself.
+type bridgeDiagnostics struct {
+	LastSuccessfulPoll time.Time
+	PollDuration       time.Duration
+	ConsecutiveErrors  int
+	PublishedPoints    int
+	DucFirmware        string
+	Version            string
+	Uptime             time.Duration
+}
+
+func newBridge(config *Config, configFile string, ducClient *bastec.BastecClient) *bridge {
+	poller := bastec.NewPoller(ducClient, time.Duration(config.IntervalSeconds)*time.Second)
+	// The polled values are merged into the registry before they're handed to the sinks
+	poller.Registry = bastec.NewPointRegistry(&bastec.BrowseResponse{})
+	return &bridge{
+		config:     config,
+		configFile: configFile,
+		ducClient:  ducClient,
+		notifier:   newSystemdNotifier(),
+		commands:   make(chan string, 4),
+		poller:     poller,
+		registry:   poller.Registry,
+		startTime:  time.Now(),
+		stateFile:  config.stateFile(configFile),
+		// Filled in per interval as the points are polled
+		polledPoints:  map[time.Duration]int{},
+		decimalsShown: map[string]int{},
+	}
+}
+
+// fetchDucVersion asks the DUC for its version, for the device information and diagnostics.
+func (bridge *bridge) fetchDucVersion() {
+	response, err := bridge.ducClient.GetVersion()
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to get DUC version")
+		return
+	}
+	bridge.mutex.Lock()
+	bridge.ducVersion = response.Result
+	bridge.mutex.Unlock()
+}
+
+// ducInfo returns what's known about the DUC itself, from the DUC or else from the cache.
+func (bridge *bridge) ducInfo() (devId string, ducVersion bastec.DucVersion, session bastec.Session) {
+	bridge.mutex.RLock()
+	defer bridge.mutex.RUnlock()
+	return bridge.devId, bridge.ducVersion, bridge.session
+}
+
+// decimalsShownOf returns how many decimals the DUC shows of a point, or -1 if it hasn't been polled yet.
+func (bridge *bridge) decimalsShownOf(pid string) int {
+	bridge.mutex.RLock()
+	defer bridge.mutex.RUnlock()
+	if decimalsShown, found := bridge.decimalsShown[pid]; found {
+		return decimalsShown
+	}
+	return -1
+}
+
+// loadCache publishes the points of the last good browse, so that the sensors are there before the DUC
+// answers, or even if it doesn't. Without a cache, only the bridge itself is published. The DUC is browsed
+// again as soon as it answers.
+func (bridge *bridge) loadCache() {
+	bridge.mutex.Lock()
+	defer bridge.mutex.Unlock()
+	bridge.browseNeeded = true
+	cache, err := readBrowseCache(bridge.stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Debug().Msgf("No browse cache at %s", bridge.stateFile)
+		bridge.selectPoints()
+		return
+	}
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to read the browse cache, waiting for the DUC")
+		bridge.selectPoints()
+		return
+	}
+	// The disallowed prefixes may have been changed since the cache was saved
+	browsed := bridge.allowedPoints(cache.Points)
+	log.Info().Msgf("Publishing %d points from the browse cache saved at %s", len(browsed), cache.SavedAt.Format(time.DateTime))
+	bridge.browsed = browsed
+	bridge.devId = cache.DevId
+	bridge.registry.SetPoints(cache.DevId, browsed)
+	if bridge.ducVersion.Version == "" {
+		bridge.ducVersion = cache.DucVersion
+	}
+	bridge.session = cache.Session
+	if cache.DecimalsShown != nil {
+		bridge.decimalsShown = cache.DecimalsShown
+	}
+	bridge.selectPoints()
+}
+
+// saveCache saves the browsed points, so that they can be published at the next start without waiting
+// for the DUC. Must be called with the mutex held.
+func (bridge *bridge) saveCache() {
+	cache := browseCache{
+		SavedAt:       time.Now(),
+		DevId:         bridge.devId,
+		DucVersion:    bridge.ducVersion,
+		Session:       bridge.session,
+		Points:        bridge.browsed,
+		DecimalsShown: bridge.decimalsShown,
+	}
+	if err := writeBrowseCache(bridge.stateFile, cache); err != nil {
+		log.Warn().Err(err).Msg("Failed to save the browse cache")
+	}
+}
+
+func (bridge *bridge) diagnostics() bridgeDiagnostics {
+	bridge.mutex.RLock()
+	defer bridge.mutex.RUnlock()
+	return bridgeDiagnostics{
+		LastSuccessfulPoll: bridge.lastSuccessfulPoll,
+		PollDuration:       bridge.lastPollDuration,
+		ConsecutiveErrors:  bridge.consecutiveErrors,
+		PublishedPoints:    bridge.publishedPoints,
+		DucFirmware:        bridge.ducVersion.Firmware(),
+		Version:            bridge.version,
+		Uptime:             time.Since(bridge.startTime),
+	}
+}
+
+// browse fetches the points from the DUC and publishes the selected ones to the sinks. It tells whether it succeeded;
+// if not, it's retried with a growing backoff.
+func (bridge *bridge) browse() bool {
+	browse, err := bridge.ducClient.Browse()
+	if err != nil {
+		// Keep the points that are known, if any, and try again when the DUC answers
+		bridge.mutex.Lock()
+		bridge.browseNeeded = true
+		bridge.browseBackoff = min(max(2*bridge.browseBackoff, time.Duration(bridge.config.IntervalSeconds)*time.Second), maxBrowseBackoff)
+		bridge.nextBrowse = time.Now().Add(bridge.browseBackoff)
+		backoff := bridge.browseBackoff
+		bridge.mutex.Unlock()
+		log.Error().Err(err).Msgf("Failed to browse, trying again in %s", backoff)
+		return false
+	}
+
+	browsed := bridge.allowedPoints(browse.Result.Points)
+	bridge.mutex.Lock()
+	defer bridge.mutex.Unlock()
+	bridge.browsed = browsed
+	bridge.devId = browse.Result.DevId
+	bridge.registry.SetPoints(browse.Result.DevId, browsed)
+	bridge.session = bridge.ducClient.Session()
+	bridge.browseNeeded = false
+	bridge.browseBackoff = 0
+	bridge.selectPoints()
+	bridge.saveCache()
+	return true
+}
+
+// reconcileDue tells whether it's time to browse the DUC again, and if so, clears browseNeeded so that it's
+// only done once. Must be called with the mutex held.
+func (bridge *bridge) reconcileDue(now time.Time) bool {
+	if !bridge.browseNeeded || now.Before(bridge.nextBrowse) {
+		return false
+	}
+	bridge.browseNeeded = false
+	return true
+}
+
+// allowedPoints leaves out the points with disallowed prefixes.
+func (bridge *bridge) allowedPoints(points []bastec.PointConfig) (allowed []bastec.PointConfig) {
+point:
+	for _, point := range points {
+		for _, prefix := range bridge.ducClient.DisallowedPrefixes {
+			if strings.HasPrefix(point.Pid, prefix) {
+				log.Debug().Msgf("Skipping sensor %s: %s", point.Pid, point.Desc)
+				continue point
+			}
+		}
+		allowed = append(allowed, point)
+	}
+	return allowed
+}
+
+// selectPoints applies the configured points to the browsed ones and publishes the result to the sinks.
+// Must be called with the mutex held.
+func (bridge *bridge) selectPoints() {
+	pointSettings := bridge.pointSettings()
+
+	var points []bastec.PointConfig
+	for _, point := range bridge.browsed {
+		if len(pointSettings) > 0 {
+			settings, found := pointSettings[point.Pid]
+			if !found || settings.Disabled {
+				log.Debug().Msgf("Skipping sensor %s (not in points): %s", point.Pid, point.Desc)
+				continue
+			}
+			if settings.Name != "" {
+				point.Desc = settings.Name
+			}
+			if settings.Unit != "" {
+				point.Attr = settings.Unit
+			}
+		}
+		points = append(points, point)
+	}
+	bridge.points = points
+	bridge.polledPoints = map[time.Duration]int{}
+	pids := make([]string, 0, len(points))
+	for _, point := range points {
+		pids = append(pids, point.Pid)
+	}
+	intervals := pollIntervals(points, bridge.config.PollRates)
+	bridge.poller.SetPoints(pids, func(pid string) time.Duration {
+		return intervals[pid]
+	})
+	bridge.sinks.PublishPoints(points)
+}
+
+// pointSettings indexes the configured points by pid. Must be called with the mutex held.
+func (bridge *bridge) pointSettings() map[string]PointSettings {
+	pointSettings := make(map[string]PointSettings, len(bridge.config.Points))
+	for _, settings := range bridge.config.Points {
+		pointSettings[settings.Pid] = settings
+	}
+	return pointSettings
+}
+
+// settingsFor returns the configured settings of a point, if any.
+func (bridge *bridge) settingsFor(pid string) (settings PointSettings, found bool) {
+	bridge.mutex.RLock()
+	defer bridge.mutex.RUnlock()
+	for _, settings := range bridge.config.Points {
+		if settings.Pid == pid {
+			return settings, true
+		}
+	}
+	return
+}
+
+// updatePointSettings replaces the configured points, saves them to the configuration file and
+// applies them without a restart.
+func (bridge *bridge) updatePointSettings(points []PointSettings) error {
+	bridge.mutex.Lock()
+	defer bridge.mutex.Unlock()
+	if err := savePointSettings(bridge.configFile, points); err != nil {
+		return err
+	}
+	bridge.config.Points = points
+	log.Info().Msgf("Updated settings of %d points", len(points))
+	bridge.selectPoints()
+	return nil
+}
+
+// browsedPoints returns every point on the DUC that isn't disallowed, as reported by the DUC, and the configured points.
+func (bridge *bridge) browsedPoints() (browsed []bastec.PointConfig, points []PointSettings) {
+	bridge.mutex.RLock()
+	defer bridge.mutex.RUnlock()
+	return bridge.browsed, bridge.config.Points
+}
+
+// unpolledPids returns the pids of the browsed points that aren't polled.
+func (bridge *bridge) unpolledPids() (pids []string) {
+	bridge.mutex.RLock()
+	defer bridge.mutex.RUnlock()
+	polled := make(map[string]bool, len(bridge.points))
+	for _, point := range bridge.points {
+		polled[point.Pid] = true
+	}
+	for _, point := range bridge.browsed {
+		if !polled[point.Pid] {
+			pids = append(pids, point.Pid)
+		}
+	}
+	return
+}
+
+// pollStatus returns whether there are any points to poll, when values were last fetched from the DUC, and the
+// error of the last attempt.
+func (bridge *bridge) pollStatus() (polling bool, lastSuccessfulPoll time.Time, lastPollError error) {
+	bridge.mutex.RLock()
+	defer bridge.mutex.RUnlock()
+	return len(bridge.points) > 0, bridge.lastSuccessfulPoll, bridge.lastPollError
+}
+
+// republishPoints hands the polled points to the sinks again, e.g. when one of them has just connected.
+func (bridge *bridge) republishPoints() {
+	bridge.mutex.RLock()
+	defer bridge.mutex.RUnlock()
+	bridge.sinks.PublishPoints(bridge.points)
+}
+
+// command asks the bridge to do something right away, followed by polling all points.
+func (bridge *bridge) command(command string) {
+	select {
+	case bridge.commands <- command:
+	default:
+		log.Warn().Msgf("Ignoring command %s, too many commands queued", command)
+	}
+}
+
+// runCommand runs a command and tells whether the points should be polled after it. They aren't after a failed
+// browse, as the DUC isn't likely to answer the polls either.
+func (bridge *bridge) runCommand(command string) (poll bool) {
+	log.Info().Msgf("Running command %s", command)
+	switch command {
+	case commandPollNow:
+		// Polling is done right after any command
+	case commandBrowse:
+		return bridge.browse()
+	case commandReconcile:
+		bridge.fetchDucVersion()
+		return bridge.browse()
+	case commandReconnectDuc:
+		if err := bridge.ducClient.Relogin(); err != nil {
+			log.Error().Err(err).Msg("Failed to reconnect to the DUC")
+		}
+	default:
+		log.Warn().Msgf("Unknown command %s", command)
+	}
+	return true
+}
+
+// valuesPublished is called by the sinks after each successful publish.
+func (bridge *bridge) valuesPublished(_ Sink) {
+	bridge.notifier.ready()
+}
+
+// commandLoop runs the commands one at a time, and polls all points after each that succeeded.
+func (bridge *bridge) commandLoop() {
+	for command := range bridge.commands {
+		if bridge.runCommand(command) {
+			bridge.poller.PollNow()
+		}
+	}
+}
+
+// run polls the DUC until the bridge is stopped.
+func (bridge *bridge) run() {
+	bridge.notifier.checkWatchdog(bridge.poller.ShortestInterval())
+	bridge.poller.OnTick(bridge.tick)
+	bridge.poller.OnPoll(bridge.polled)
+	go bridge.commandLoop()
+	if err := bridge.poller.Run(context.Background()); err != nil {
+		log.Error().Err(err).Msg("Polling stopped")
+	}
+}
+
+// tick is called by the poller at least every poll interval, even when there is nothing to poll.
+func (bridge *bridge) tick() {
+	bridge.notifier.watchdog()
+	bridge.mutex.Lock()
+	hasPoints := len(bridge.points) > 0
+	// Without any polled points, e.g. when none of the cached ones are selected, there are no polls to tell
+	// whether the DUC answers, so browsing is just retried
+	reconcile := !hasPoints && bridge.reconcileDue(time.Now())
+	bridge.mutex.Unlock()
+	if !hasPoints {
+		// There are no values to wait for before telling systemd that the bridge is up
+		bridge.notifier.ready()
+	}
+	if reconcile {
+		log.Info().Msg("Browsing the DUC again")
+		bridge.command(commandReconcile)
+	}
+}
+
+// polled records the outcome of a poll and hands the values to the sinks.
+func (bridge *bridge) polled(result bastec.PollResult) {
+	pollDuration.Observe(result.Duration.Seconds())
+	err := result.Err
+	var partialErr *bastec.PartialValuesError
+	if errors.As(err, &partialErr) {
+		// The values that could be fetched are still published
+		for _, chunk := range partialErr.Chunks {
+			ducRequestErrors.Inc()
+			log.Error().Err(chunk.Err).Msgf("Failed to get values of %d points starting with %s", len(chunk.Pids), chunk.Pids[0])
+		}
+		err = nil
+	}
+
+	bridge.mutex.Lock()
+	bridge.lastPollError = err
+	bridge.lastPollDuration = result.Duration
+	if err == nil {
+		bridge.polledPoints[result.Interval] = len(result.Points)
+		bridge.lastSuccessfulPoll = time.Now()
+		bridge.consecutiveErrors = 0
+		bridge.publishedPoints = 0
+		for _, polledPoints := range bridge.polledPoints {
+			bridge.publishedPoints += polledPoints
+		}
+	} else {
+		bridge.consecutiveErrors++
+	}
+	polledPoints := bridge.publishedPoints
+	reconcile := err == nil && bridge.reconcileDue(time.Now())
+	decimalsChanged := false
+	for _, point := range result.Points {
+		if decimalsShown, found := bridge.decimalsShown[point.Pid]; !found || decimalsShown != point.DecimalsShown {
+			bridge.decimalsShown[point.Pid] = point.DecimalsShown
+			decimalsChanged = true
+		}
+	}
+	if decimalsChanged && !reconcile {
+		bridge.saveCache()
+	}
+	bridge.mutex.Unlock()
+	if reconcile {
+		log.Info().Msg("Browsing the DUC again")
+		bridge.command(commandReconcile)
+	}
+	if err != nil {
+		ducRequestErrors.Inc()
+		if errors.Is(err, bastec.ErrAuthFailed) {
+			log.Error().Err(err).Msg("The DUC doesn't accept the user and password in duc.url")
+		}
+		log.Error().Err(err).Msgf("Failed to get values polled every %s", result.Interval)
+		bridge.notifier.status(fmt.Sprintf("Failed to poll the DUC: %s", err))
+		return
+	}
+	lastSuccessfulPoll.SetToCurrentTime()
+	publishedPoints.Set(float64(polledPoints))
+	bridge.sinks.PublishValues(result.Time, result.Points)
+	bridge.notifier.status(fmt.Sprintf("Polled %d points at %s", len(result.Points), time.Now().Format(time.TimeOnly)))
+}
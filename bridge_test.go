@@ -0,0 +1,75 @@
+package main
+
+import (
+	"github.com/SourceForgery/duc2mqtt/bastec"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+var cachedPoints = []bastec.PointConfig{
+	{Pid: "1.ai.1", Desc: "Outdoor temperature"},
+	{Pid: "1.em.1", Desc: "Energy total"},
+	{Pid: "1.ai.2", Desc: "Supply air"},
+}
+
+// newCachedBridge returns a bridge of a DUC that can't be reached, with cachedPoints in its browse cache.
+func newCachedBridge(t *testing.T, config *Config, disallowedPrefixes ...string) *bridge {
+	t.Helper()
+	t.Setenv("NOTIFY_SOCKET", "")
+	config.IntervalSeconds = 10
+	config.Duc.StateFile = filepath.Join(t.TempDir(), defaultStateFile)
+	err := writeBrowseCache(config.Duc.StateFile, browseCache{SavedAt: time.Now(), DevId: "DUC-1234", Points: cachedPoints})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ducClient, err := bastec.NewClient(url.URL{Scheme: "http", Host: "127.0.0.1:1", User: url.UserPassword("admin", "secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ducClient.DisallowedPrefixes = disallowedPrefixes
+	bridge := newBridge(config, "config.yaml", ducClient)
+	bridge.sinks = newSinks(func(Sink) {})
+	return bridge
+}
+
+func TestLoadCacheLeavesOutDisallowedPoints(t *testing.T) {
+	// Disallowed after the cache was saved
+	bridge := newCachedBridge(t, &Config{}, "1.em.")
+
+	bridge.loadCache()
+	browsed, _ := bridge.browsedPoints()
+	var pids []string
+	for _, point := range browsed {
+		pids = append(pids, point.Pid)
+	}
+	if !slices.Equal(pids, []string{"1.ai.1", "1.ai.2"}) {
+		t.Errorf("loaded %v from the cache, expected the points that aren't disallowed", pids)
+	}
+	if polling, _, _ := bridge.pollStatus(); !polling {
+		t.Error("the cached points aren't polled")
+	}
+}
+
+func TestTickBrowsesAgainWithoutPolledPoints(t *testing.T) {
+	// None of the cached points are polled, so there are no polls to tell when the DUC answers
+	config := &Config{Points: []PointSettings{{Pid: "1.ai.1", Disabled: true}}}
+	bridge := newCachedBridge(t, config)
+	bridge.loadCache()
+
+	bridge.tick()
+	select {
+	case command := <-bridge.commands:
+		if command != commandReconcile {
+			t.Errorf("got the command %s, expected %s", command, commandReconcile)
+		}
+	default:
+		t.Fatal("the DUC isn't browsed again")
+	}
+	bridge.tick()
+	if len(bridge.commands) != 0 {
+		t.Error("browsing again more than once at a time")
+	}
+}
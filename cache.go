@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/SourceForgery/duc2mqtt/bastec"
+	"github.com/rotisserie/eris"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// defaultStateFile is where the browse cache is kept unless configured, relative to the configuration file.
+const defaultStateFile = "duc2mqtt-state.json"
+
+// browseCache is the last good browse of the DUC, so that the sensors can be published at startup
+// without waiting for the DUC, and kept while it's down.
+type browseCache struct {
+	SavedAt    time.Time            `json:"savedAt"`
+	DevId      string               `json:"devId"`
+	DucVersion bastec.DucVersion    `json:"ducVersion"`
+	Session    bastec.Session       `json:"session"`
+	Points     []bastec.PointConfig `json:"points"`
+	// DecimalsShown is how many decimals the DUC shows of each point. Along with the points and the
+	// configured settings, it's what the sensor configurations are computed from.
+	DecimalsShown map[string]int `json:"decimalsShown"`
+}
+
+// stateFile returns the path of the browse cache.
+func (config *Config) stateFile(configFile string) string {
+	if config.Duc.StateFile != "" {
+		return config.Duc.StateFile
+	}
+	return filepath.Join(filepath.Dir(configFile), defaultStateFile)
+}
+
+func readBrowseCache(path string) (cache browseCache, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cache, eris.Wrapf(err, "failed to read %s", path)
+	}
+	if err = json.Unmarshal(data, &cache); err != nil {
+		return cache, eris.Wrapf(err, "failed to parse %s", path)
+	}
+	return cache, nil
+}
+
+// writeBrowseCache replaces the cache through a temporary file, so that a crash can't leave half a cache behind.
+func writeBrowseCache(path string, cache browseCache) error {
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return eris.Wrap(err, "failed to serialize the browse cache")
+	}
+	tempFile := path + ".tmp"
+	if err = os.WriteFile(tempFile, data, 0600); err != nil {
+		return eris.Wrapf(err, "failed to write %s", tempFile)
+	}
+	if err = os.Rename(tempFile, path); err != nil {
+		return eris.Wrapf(err, "failed to replace %s", path)
+	}
+	return nil
+}
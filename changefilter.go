@@ -0,0 +1,89 @@
+package main
+
+import (
+	"github.com/SourceForgery/duc2mqtt/bastec"
+	"math"
+	"time"
+)
+
+// defaultHeartbeatSeconds is the longest an unchanged value goes unpublished unless configured otherwise.
+const defaultHeartbeatSeconds = 300
+
+// Deadband is how much a value must change before it's published again.
+// If both are set, the change must exceed both.
+type Deadband struct {
+	// Absolute is the smallest change published, in the unit of the point.
+	Absolute float64 `yaml:"absolute,omitempty" json:"absolute,omitempty"`
+	// Percent is the smallest change published, relative to the last published value.
+	Percent float64 `yaml:"percent,omitempty" json:"percent,omitempty"`
+}
+
+func (deadband Deadband) exceeded(previous float64, value float64) bool {
+	change := math.Abs(value - previous)
+	return change > deadband.Absolute && change > math.Abs(previous)*deadband.Percent/100
+}
+
+type publishedValue struct {
+	value float64
+	time  time.Time
+}
+
+// changeFilter drops values that haven't changed by more than their deadband since they were last
+// published, unless they've gone unpublished for longer than the heartbeat.
+type changeFilter struct {
+	// heartbeat is negative if every value is to be published
+	heartbeat time.Duration
+	deadbands map[string]Deadband
+	published map[string]publishedValue
+}
+
+func newChangeFilter(heartbeat time.Duration) *changeFilter {
+	return &changeFilter{
+		heartbeat: heartbeat,
+		deadbands: map[string]Deadband{},
+		published: map[string]publishedValue{},
+	}
+}
+
+// setPoints sets the deadbands of the points to filter. Points no longer published are forgotten.
+func (filter *changeFilter) setPoints(points []bastec.PointConfig, deadbandFor func(point bastec.PointConfig) Deadband) {
+	deadbands := make(map[string]Deadband, len(points))
+	for _, point := range points {
+		// Alarms are published as soon as they change
+		if point.Type == "enum" {
+			deadbands[point.Pid] = Deadband{}
+		} else {
+			deadbands[point.Pid] = deadbandFor(point)
+		}
+	}
+	for pid := range filter.published {
+		if _, found := deadbands[pid]; !found {
+			delete(filter.published, pid)
+		}
+	}
+	filter.deadbands = deadbands
+}
+
+// changed returns the values that should be published now.
+func (filter *changeFilter) changed(now time.Time, values []bastec.Point) []bastec.Point {
+	if filter.heartbeat < 0 {
+		return values
+	}
+	changed := make([]bastec.Point, 0, len(values))
+	for _, value := range values {
+		published, found := filter.published[value.Pid]
+		if !found ||
+			now.Sub(published.time) >= filter.heartbeat ||
+			filter.deadbands[value.Pid].exceeded(published.value, value.Value) {
+			changed = append(changed, value)
+		}
+	}
+	return changed
+}
+
+// markPublished records values as successfully published.
+func (filter *changeFilter) markPublished(now time.Time, values []bastec.Point) {
+	for _, value := range values {
+		filter.published[value.Pid] = publishedValue{value: value.Value, time: now}
+	}
+}
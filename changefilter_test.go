@@ -0,0 +1,104 @@
+package main
+
+import (
+	"github.com/SourceForgery/duc2mqtt/bastec"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDeadbandExceeded(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		deadband Deadband
+		previous float64
+		value    float64
+		expected bool
+	}{
+		{"no deadband, unchanged", Deadband{}, 21.5, 21.5, false},
+		{"no deadband, changed", Deadband{}, 21.5, 21.6, true},
+		{"absolute, within", Deadband{Absolute: 0.5}, 21, 21.5, false},
+		{"absolute, beyond", Deadband{Absolute: 0.5}, 21, 21.6, true},
+		{"absolute, falling", Deadband{Absolute: 0.5}, 21, 20.4, true},
+		{"percent, within", Deadband{Percent: 10}, 200, 219, false},
+		{"percent, beyond", Deadband{Percent: 10}, 200, 221, true},
+		{"percent of a negative value", Deadband{Percent: 10}, -200, -221, true},
+		// Any change away from 0 is beyond a percentage of it
+		{"percent of 0, unchanged", Deadband{Percent: 10}, 0, 0, false},
+		{"percent of 0, changed", Deadband{Percent: 10}, 0, 0.01, true},
+		{"both, beyond absolute only", Deadband{Absolute: 1, Percent: 10}, 200, 202, false},
+		{"both, beyond percent only", Deadband{Absolute: 1, Percent: 10}, 5, 5.9, false},
+		{"both, beyond both", Deadband{Absolute: 1, Percent: 10}, 200, 221, true},
+	} {
+		if exceeded := test.deadband.exceeded(test.previous, test.value); exceeded != test.expected {
+			t.Errorf("%s: %+v exceeded from %g to %g is %v", test.name, test.deadband, test.previous, test.value, exceeded)
+		}
+	}
+}
+
+func changedPids(filter *changeFilter, now time.Time, values ...bastec.Point) (pids []string) {
+	changed := filter.changed(now, values)
+	filter.markPublished(now, changed)
+	for _, value := range changed {
+		pids = append(pids, value.Pid)
+	}
+	return
+}
+
+func TestChangeFilter(t *testing.T) {
+	filter := newChangeFilter(5 * time.Minute)
+	filter.setPoints([]bastec.PointConfig{
+		{Pid: "1.ai.1", Type: "number", Attr: "°C"},
+		{Pid: "1.al.1", Type: "enum"},
+	}, func(point bastec.PointConfig) Deadband {
+		// Alarms are published on any change, whatever their deadband
+		return Deadband{Absolute: 1}
+	})
+	start := time.Now()
+
+	if pids := changedPids(filter, start, bastec.Point{Pid: "1.ai.1", Value: 20}, bastec.Point{Pid: "1.al.1", Value: 0}); len(pids) != 2 {
+		t.Errorf("published %v at first, expected every value", pids)
+	}
+	pids := changedPids(filter, start.Add(time.Minute), bastec.Point{Pid: "1.ai.1", Value: 20.5}, bastec.Point{Pid: "1.al.1", Value: 1})
+	if !slices.Equal(pids, []string{"1.al.1"}) {
+		t.Errorf("published %v, expected only the alarm", pids)
+	}
+	// The deadband is relative to the last published value, not the last polled one
+	pids = changedPids(filter, start.Add(2*time.Minute), bastec.Point{Pid: "1.ai.1", Value: 21.5}, bastec.Point{Pid: "1.al.1", Value: 1})
+	if !slices.Equal(pids, []string{"1.ai.1"}) {
+		t.Errorf("published %v, expected the temperature that changed by 1.5 since it was published", pids)
+	}
+	// The heartbeat publishes unchanged values
+	pids = changedPids(filter, start.Add(6*time.Minute), bastec.Point{Pid: "1.ai.1", Value: 21.5}, bastec.Point{Pid: "1.al.1", Value: 1})
+	if !slices.Equal(pids, []string{"1.al.1"}) {
+		t.Errorf("published %v, expected the alarm that wasn't published for 5 minutes", pids)
+	}
+	pids = changedPids(filter, start.Add(7*time.Minute), bastec.Point{Pid: "1.ai.1", Value: 21.5}, bastec.Point{Pid: "1.al.1", Value: 1})
+	if !slices.Equal(pids, []string{"1.ai.1"}) {
+		t.Errorf("published %v, expected the temperature that wasn't published for 5 minutes", pids)
+	}
+}
+
+func TestChangeFilterForgetsPointsNoLongerPublished(t *testing.T) {
+	filter := newChangeFilter(5 * time.Minute)
+	filter.setPoints([]bastec.PointConfig{{Pid: "1.ai.1"}}, func(bastec.PointConfig) Deadband { return Deadband{Absolute: 1} })
+	now := time.Now()
+	changedPids(filter, now, bastec.Point{Pid: "1.ai.1", Value: 20})
+
+	filter.setPoints(nil, nil)
+	filter.setPoints([]bastec.PointConfig{{Pid: "1.ai.1"}}, func(bastec.PointConfig) Deadband { return Deadband{Absolute: 1} })
+	if pids := changedPids(filter, now, bastec.Point{Pid: "1.ai.1", Value: 20}); len(pids) != 1 {
+		t.Errorf("published %v, expected a point published again to be published right away", pids)
+	}
+}
+
+func TestChangeFilterWithoutHeartbeatPublishesEverything(t *testing.T) {
+	filter := newChangeFilter(-1)
+	filter.setPoints([]bastec.PointConfig{{Pid: "1.ai.1"}}, func(bastec.PointConfig) Deadband { return Deadband{Absolute: 1} })
+	now := time.Now()
+	for range 2 {
+		if pids := changedPids(filter, now, bastec.Point{Pid: "1.ai.1", Value: 20}); len(pids) != 1 {
+			t.Errorf("published %v, expected every value", pids)
+		}
+	}
+}
@@ -1,9 +1,5 @@
 package hassio
 
-import (
-	"fmt"
-)
-
 var _ SensorConfig = (*AlarmSensorConfig)(nil)
 
 type AlarmSensorConfig struct {
@@ -42,7 +38,7 @@ func (a AlarmSensorConfig) SensorId() string {
 	return a.sensorId
 }
 
-func (a AlarmSensorConfig) ConvertValue(value float64) string {
+func (a AlarmSensorConfig) ConvertValue(value float64, _ int) string {
 	if value > 0 {
 		return "ON"
 	}
@@ -50,7 +46,7 @@ func (a AlarmSensorConfig) ConvertValue(value float64) string {
 }
 
 func (a AlarmSensorConfig) ValueTemplate() string {
-	return fmt.Sprintf("{{ value_json['%s'] }}", a.sensorId)
+	return "{{ value }}"
 }
 
 func (a AlarmSensorConfig) StateClass() string {
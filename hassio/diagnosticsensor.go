@@ -0,0 +1,69 @@
+package hassio
+
+import (
+	"fmt"
+)
+
+var _ SensorConfig = (*DiagnosticSensorConfig)(nil)
+
+// DiagnosticSensorConfig is a sensor about the bridge itself rather than the DUC.
+// Home Assistant shows it under diagnostics on the device page.
+type DiagnosticSensorConfig struct {
+	sensorId          string
+	name              string
+	deviceClass       string
+	unitOfMeasurement string
+	stateClass        string
+}
+
+func NewDiagnosticSensorConfig(
+	sensorId string,
+	name string,
+	deviceClass string,
+	unitOfMeasurement string,
+	stateClass string,
+) *DiagnosticSensorConfig {
+	return &DiagnosticSensorConfig{
+		sensorId,
+		name,
+		deviceClass,
+		unitOfMeasurement,
+		stateClass,
+	}
+}
+
+func (d *DiagnosticSensorConfig) DeviceClass() string {
+	return d.deviceClass
+}
+
+func (d *DiagnosticSensorConfig) Name() string {
+	return d.name
+}
+
+func (d *DiagnosticSensorConfig) UnitOfMeasurement() string {
+	return d.unitOfMeasurement
+}
+
+func (d *DiagnosticSensorConfig) SensorType() string {
+	return "sensor"
+}
+
+func (d *DiagnosticSensorConfig) Decimals() int {
+	return -1
+}
+
+func (d *DiagnosticSensorConfig) ConvertValue(value float64, _ int) string {
+	return fmt.Sprintf("%g", value)
+}
+
+// ValueTemplate picks the sensor from the diagnostics, which share a state topic. Sensors that aren't in the
+// diagnostics yet, like the last poll before the first successful one, render as None, i.e. unknown.
+func (d *DiagnosticSensorConfig) ValueTemplate() string {
+	return fmt.Sprintf("{{ value_json['%s'] | default(None) }}", d.sensorId)
+}
+
+func (d *DiagnosticSensorConfig) StateClass() string {
+	return d.stateClass
+}
+
+func (d *DiagnosticSensorConfig) SensorId() string { return d.sensorId }
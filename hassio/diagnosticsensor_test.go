@@ -0,0 +1,10 @@
+package hassio
+
+import "testing"
+
+func TestDiagnosticValueTemplateToleratesMissingSensors(t *testing.T) {
+	config := NewDiagnosticSensorConfig("last_poll", "Last successful poll", "timestamp", "", "")
+	if template := config.ValueTemplate(); template != "{{ value_json['last_poll'] | default(None) }}" {
+		t.Errorf("got the template %s, expected one that renders None without the sensor", template)
+	}
+}
@@ -1,7 +1,7 @@
 package hassio
 
 import (
-	"fmt"
+	"strconv"
 )
 
 var _ SensorConfig = (*FloatSensorConfig)(nil)
@@ -12,6 +12,7 @@ type FloatSensorConfig struct {
 	deviceClass       string
 	unitOfMeasurement string
 	stateClass        string
+	decimals          int
 }
 
 func NewFloatSensorConfig(
@@ -20,6 +21,7 @@ func NewFloatSensorConfig(
 	deviceClass string,
 	unitOfMeasurement string,
 	stateClass string,
+	decimals int,
 ) *FloatSensorConfig {
 	return &FloatSensorConfig{
 		sensorId,
@@ -27,6 +29,7 @@ func NewFloatSensorConfig(
 		deviceClass,
 		unitOfMeasurement,
 		stateClass,
+		decimals,
 	}
 }
 
@@ -46,12 +49,24 @@ func (f *FloatSensorConfig) SensorType() string {
 	return "sensor"
 }
 
-func (f *FloatSensorConfig) ConvertValue(value float64) string {
-	return fmt.Sprintf("%f", value)
+func (f *FloatSensorConfig) Decimals() int {
+	return f.decimals
+}
+
+// WithDecimals returns a copy of the sensor that Home Assistant should display with another number of decimals.
+// The sensor itself isn't changed, as it may be published concurrently.
+func (f *FloatSensorConfig) WithDecimals(decimals int) *FloatSensorConfig {
+	updated := *f
+	updated.decimals = decimals
+	return &updated
+}
+
+func (f *FloatSensorConfig) ConvertValue(value float64, decimals int) string {
+	return strconv.FormatFloat(value, 'f', decimals, 64)
 }
 
 func (f *FloatSensorConfig) ValueTemplate() string {
-	return fmt.Sprintf("{{ value_json['%s'] | float }}", f.sensorId)
+	return "{{ value | float }}"
 }
 
 func (f *FloatSensorConfig) StateClass() string {
@@ -31,7 +31,10 @@ type SensorConfig interface {
 	SensorId() string
 	UnitOfMeasurement() string
 	SensorType() string
-	ConvertValue(value float64) string
+	// Decimals is how many decimals Home Assistant should display, or -1 if unknown
+	Decimals() int
+	// ConvertValue formats a value with the given number of decimals, as the DUC reports it with
+	ConvertValue(value float64, decimals int) string
 	ValueTemplate() string
 	StateClass() string
 }
@@ -48,27 +51,57 @@ type SensorConfigX struct {
 // DiscoveryMessage represents the discovery payload to be sent to Home Assistant.
 type DiscoveryMessage struct {
 	Name              string  `json:"name"`
-	DeviceClass       string  `json:"device_class"`
+	DeviceClass       string  `json:"device_class,omitempty"`
 	UniqueID          string  `json:"unique_id"`               // The sensor id
 	StateTopic        string  `json:"state_topic"`             // Shared by all devices
 	CommandTopic      string  `json:"command_topic,omitempty"` // Not used by this device
 	ValueTemplate     string  `json:"value_template"`          // Converts the sensor state payload to string, e.g. '{{ value_json.power_meter}}'
 	UnitOfMeasurement string  `json:"unit_of_measurement,omitempty"`
+	DisplayPrecision  *int    `json:"suggested_display_precision,omitempty"`
 	Device            *Device `json:"device"`
 	StateClass        string  `json:"state_class,omitempty"`
+	EntityCategory    string  `json:"entity_category,omitempty"`
+	Origin            *Origin `json:"origin,omitempty"`
+}
+
+// ButtonDiscoveryMessage represents the discovery payload of a button.
+type ButtonDiscoveryMessage struct {
+	Name           string  `json:"name"`
+	UniqueID       string  `json:"unique_id"`
+	CommandTopic   string  `json:"command_topic"`
+	PayloadPress   string  `json:"payload_press"`
+	Device         *Device `json:"device"`
+	DeviceClass    string  `json:"device_class,omitempty"`
+	EntityCategory string  `json:"entity_category,omitempty"`
+	Origin         *Origin `json:"origin,omitempty"`
+}
+
+// Button is a button entity in Home Assistant. Presses are passed to Client.OnButtonPressed.
+type Button struct {
+	Id          string
+	Name        string
+	DeviceClass string
+}
+
+// Origin represents the software publishing the discovery messages.
+type Origin struct {
+	Name       string `json:"name"`
+	SWVersion  string `json:"sw_version,omitempty"`
+	SupportURL string `json:"support_url,omitempty"`
 }
 
 // Device represents the device information for Home Assistant.
 type Device struct {
 	Identifiers      []string `json:"identifiers"`
 	Name             string   `json:"name"`
-	SWVersion        string   `json:"sw_version"`
-	HWVersion        string   `json:"hw_version"`
-	SerialNumber     string   `json:"serial_number"`
-	Model            string   `json:"model"`
-	ModelID          string   `json:"model_id"`
-	Manufacturer     string   `json:"manufacturer"`
-	ConfigurationURL string   `json:"configuration_url"`
+	SWVersion        string   `json:"sw_version,omitempty"`
+	HWVersion        string   `json:"hw_version,omitempty"`
+	SerialNumber     string   `json:"serial_number,omitempty"`
+	Model            string   `json:"model,omitempty"`
+	ModelID          string   `json:"model_id,omitempty"`
+	Manufacturer     string   `json:"manufacturer,omitempty"`
+	ConfigurationURL string   `json:"configuration_url,omitempty"`
+	SuggestedArea    string   `json:"suggested_area,omitempty"`
 }
 
 type SensorState struct {
@@ -79,9 +112,79 @@ func MqttName(sensorId string) string {
 	return strings.ReplaceAll(sensorId, ".", "_")
 }
 
+// SetDevice replaces the device the sensors belong to. It's published with the next discovery messages.
+func (hassioClient *Client) SetDevice(device Device) {
+	hassioClient.mutex.Lock()
+	defer hassioClient.mutex.Unlock()
+	hassioClient.device = &device
+}
+
+// Device returns a copy of the device the sensors belong to.
+func (hassioClient *Client) Device() Device {
+	hassioClient.mutex.RLock()
+	defer hassioClient.mutex.RUnlock()
+	if hassioClient.device == nil {
+		return Device{}
+	}
+	return *hassioClient.device
+}
+
+func (hassioClient *Client) hasDevice() bool {
+	hassioClient.mutex.RLock()
+	defer hassioClient.mutex.RUnlock()
+	return hassioClient.device != nil
+}
+
+// SetSensorConfigurations replaces the sensors, by sensor id, and returns the previous ones.
+// The map must not be changed afterwards.
+func (hassioClient *Client) SetSensorConfigurations(sensorConfigs map[string]SensorConfig) (previous map[string]SensorConfig) {
+	hassioClient.mutex.Lock()
+	defer hassioClient.mutex.Unlock()
+	previous = hassioClient.sensorConfigs
+	hassioClient.sensorConfigs = sensorConfigs
+	return
+}
+
+// SetSensorConfiguration replaces a single sensor, e.g. when its configuration changed.
+func (hassioClient *Client) SetSensorConfiguration(config SensorConfig) {
+	hassioClient.mutex.Lock()
+	defer hassioClient.mutex.Unlock()
+	sensorConfigs := make(map[string]SensorConfig, len(hassioClient.sensorConfigs)+1)
+	for sensorId, sensorConfig := range hassioClient.sensorConfigs {
+		sensorConfigs[sensorId] = sensorConfig
+	}
+	sensorConfigs[config.SensorId()] = config
+	hassioClient.sensorConfigs = sensorConfigs
+}
+
+// SensorConfigurations returns the sensors, by sensor id. The map must not be changed.
+func (hassioClient *Client) SensorConfigurations() map[string]SensorConfig {
+	hassioClient.mutex.RLock()
+	defer hassioClient.mutex.RUnlock()
+	return hassioClient.sensorConfigs
+}
+
+// SensorConfiguration returns a sensor by its id, or nil if there is none.
+func (hassioClient *Client) SensorConfiguration(sensorId string) SensorConfig {
+	hassioClient.mutex.RLock()
+	defer hassioClient.mutex.RUnlock()
+	return hassioClient.sensorConfigs[sensorId]
+}
+
+// discoveryDevice returns a copy of the device for a discovery message.
+func (hassioClient *Client) discoveryDevice() *Device {
+	hassioClient.mutex.RLock()
+	defer hassioClient.mutex.RUnlock()
+	if hassioClient.device == nil {
+		return nil
+	}
+	device := *hassioClient.device
+	return &device
+}
+
 func (hassioClient *Client) sensorTypes() []string {
 	sensorTypes := make([]string, 0)
-	for _, config := range hassioClient.SensorConfigurationData {
+	for _, config := range hassioClient.SensorConfigurations() {
 		if !slices.Contains(sensorTypes, config.SensorType()) {
 			sensorTypes = append(sensorTypes, config.SensorType())
 		}
@@ -100,29 +203,123 @@ func (hassioClient *Client) SendAvailability() (err error) {
 }
 
 func (hassioClient *Client) SendConfigurationData() (err error) {
-	for sensorId, config := range hassioClient.SensorConfigurationData {
+	for _, config := range hassioClient.SensorConfigurations() {
+		err = hassioClient.SendSensorConfiguration(config)
+		if err != nil {
+			return
+		}
+	}
+	device := hassioClient.discoveryDevice()
+	for sensorId, config := range hassioClient.DiagnosticConfigurationData {
 		payload := DiscoveryMessage{
 			Name:              config.Name(),
 			DeviceClass:       config.DeviceClass(),
-			UniqueID:          sensorId,
-			StateTopic:        fmt.Sprintf("%s/%s/%s/state", hassioClient.prefix, config.SensorType(), hassioClient.uniqueDeviceId),
+			UniqueID:          fmt.Sprintf("%s_%s", hassioClient.uniqueDeviceId, sensorId),
+			StateTopic:        hassioClient.diagnosticStateTopic(),
 			ValueTemplate:     config.ValueTemplate(),
 			UnitOfMeasurement: config.UnitOfMeasurement(),
-			Device:            hassioClient.Device,
+			Device:            device,
 			StateClass:        config.StateClass(),
+			EntityCategory:    "diagnostic",
+			Origin:            hassioClient.Origin,
 		}
 		err = hassioClient.sendMessage(fmt.Sprintf("%s/%s/%s/%s/config", hassioClient.prefix, config.SensorType(), hassioClient.uniqueDeviceId, MqttName(sensorId)), payload)
 		if err != nil {
 			return
 		}
 	}
+	return hassioClient.sendButtonConfigurationData()
+}
+
+// SendSensorConfiguration publishes the discovery message of a single sensor, e.g. when its configuration changed.
+func (hassioClient *Client) SendSensorConfiguration(config SensorConfig) error {
+	payload := DiscoveryMessage{
+		Name:              config.Name(),
+		DeviceClass:       config.DeviceClass(),
+		UniqueID:          config.SensorId(),
+		StateTopic:        hassioClient.sensorStateTopic(config),
+		ValueTemplate:     config.ValueTemplate(),
+		UnitOfMeasurement: config.UnitOfMeasurement(),
+		Device:            hassioClient.discoveryDevice(),
+		StateClass:        config.StateClass(),
+		Origin:            hassioClient.Origin,
+	}
+	// Only sensors have a display precision, binary sensors don't
+	if decimals := config.Decimals(); decimals >= 0 && config.SensorType() == "sensor" {
+		payload.DisplayPrecision = &decimals
+	}
+	return hassioClient.sendMessage(fmt.Sprintf("%s/%s/%s/%s/config", hassioClient.prefix, config.SensorType(), hassioClient.uniqueDeviceId, MqttName(config.SensorId())), payload)
+}
+
+func (hassioClient *Client) buttonCommandTopic(buttonId string) string {
+	return fmt.Sprintf("%s/button/%s/%s/command", hassioClient.prefix, hassioClient.uniqueDeviceId, buttonId)
+}
+
+func (hassioClient *Client) sendButtonConfigurationData() (err error) {
+	device := hassioClient.discoveryDevice()
+	for _, button := range hassioClient.Buttons {
+		payload := ButtonDiscoveryMessage{
+			Name:           button.Name,
+			UniqueID:       fmt.Sprintf("%s_%s", hassioClient.uniqueDeviceId, button.Id),
+			CommandTopic:   hassioClient.buttonCommandTopic(button.Id),
+			PayloadPress:   "PRESS",
+			Device:         device,
+			DeviceClass:    button.DeviceClass,
+			EntityCategory: "diagnostic",
+			Origin:         hassioClient.Origin,
+		}
+		err = hassioClient.sendMessage(fmt.Sprintf("%s/button/%s/%s/config", hassioClient.prefix, hassioClient.uniqueDeviceId, button.Id), payload)
+		if err != nil {
+			return
+		}
+	}
 	return nil
 }
 
-func (hassioClient *Client) SendSensorData(sensorType string, sensorStates map[string]string) (err error) {
-	err = hassioClient.sendMessage(fmt.Sprintf("%s/%s/%s/state", hassioClient.prefix, sensorType, hassioClient.uniqueDeviceId), sensorStates)
+func (hassioClient *Client) diagnosticStateTopic() string {
+	return fmt.Sprintf("%s/sensor/%s/diagnostics/state", hassioClient.prefix, hassioClient.uniqueDeviceId)
+}
+
+// SendDiagnosticData publishes the state of all sensors in DiagnosticConfigurationData.
+func (hassioClient *Client) SendDiagnosticData(diagnosticStates map[string]string) (err error) {
+	err = hassioClient.sendMessage(hassioClient.diagnosticStateTopic(), diagnosticStates)
 	if err != nil {
-		return eris.Wrap(err, "Couldn't send sensor state\n")
+		return eris.Wrap(err, "Couldn't send diagnostic state\n")
+	}
+	return
+}
+
+func (hassioClient *Client) sensorStateTopic(config SensorConfig) string {
+	return fmt.Sprintf("%s/%s/%s/%s/state", hassioClient.prefix, config.SensorType(), hassioClient.uniqueDeviceId, MqttName(config.SensorId()))
+}
+
+// SendConfigurationRemoval makes Home Assistant forget a sensor that is no longer published.
+func (hassioClient *Client) SendConfigurationRemoval(config SensorConfig) (err error) {
+	topic := fmt.Sprintf("%s/%s/%s/%s/config", hassioClient.prefix, config.SensorType(), hassioClient.uniqueDeviceId, MqttName(config.SensorId()))
+	token := hassioClient.client.Publish(topic, 0, false, "")
+	token.Wait()
+	if err = token.Error(); err != nil {
+		return eris.Wrapf(err, "Couldn't remove configuration of %s\n", config.SensorId())
+	}
+	// An empty retained message clears the last state from the broker
+	if err = hassioClient.publishRetained(hassioClient.sensorStateTopic(config), ""); err != nil {
+		return eris.Wrapf(err, "Couldn't remove state of %s\n", config.SensorId())
+	}
+	return
+}
+
+// SendSensorData publishes the states of the given sensors, each to its own retained topic so that
+// unchanged sensors don't have to be published again and Home Assistant gets the last states when it restarts.
+func (hassioClient *Client) SendSensorData(sensorStates map[string]string) (err error) {
+	for sensorId, state := range sensorStates {
+		config := hassioClient.SensorConfiguration(sensorId)
+		if config == nil {
+			continue
+		}
+		err = hassioClient.publishRetained(hassioClient.sensorStateTopic(config), state)
+		if err != nil {
+			return eris.Wrap(err, "Couldn't send sensor state\n")
+		}
 	}
 	return
 }
@@ -146,7 +343,30 @@ func (hassioClient *Client) SubscribeToHomeAssistantStatus() (err error) {
 		err = hassioClient.SendConfigurationData()
 	}
 	if err == nil {
-		err = hassioClient.client.Subscribe(fmt.Sprintf("%s/status", hassioClient.prefix), 0, func(client MQTT.Client, msg MQTT.Message) {
+		err = hassioClient.subscribe()
+	}
+	if err != nil {
+		return eris.Wrap(err, "Couldn't subscribe to Home Assistant status\n")
+	}
+	hassioClient.subscribed.Store(true)
+	return
+}
+
+// subscribe subscribes to the button commands and the status of Home Assistant. It's done again whenever the
+// connection is re-established, as the broker forgets the subscriptions of a clean session.
+func (hassioClient *Client) subscribe() (err error) {
+	if len(hassioClient.Buttons) > 0 {
+		err = waitFor(hassioClient.client.Subscribe(hassioClient.buttonCommandTopic("+"), 0, func(client MQTT.Client, msg MQTT.Message) {
+			for _, button := range hassioClient.Buttons {
+				if msg.Topic() == hassioClient.buttonCommandTopic(button.Id) && hassioClient.OnButtonPressed != nil {
+					logger().Info().Msgf("Button '%s' pressed", button.Name)
+					hassioClient.OnButtonPressed(button.Id)
+				}
+			}
+		}))
+	}
+	if err == nil {
+		err = waitFor(hassioClient.client.Subscribe(fmt.Sprintf("%s/status", hassioClient.prefix), 0, func(client MQTT.Client, msg MQTT.Message) {
 			if string(msg.Payload()) == "online" {
 				if err := hassioClient.SendAvailability(); err != nil {
 					logger().Error().Err(err).Msg("Failed to subscribe to Home Assistant status")
@@ -156,10 +376,13 @@ func (hassioClient *Client) SubscribeToHomeAssistantStatus() (err error) {
 					logger().Error().Err(err).Msg("Failed to subscribe to Home Assistant status")
 				}
 			}
-		}).Error()
-	}
-	if err != nil {
-		return eris.Wrap(err, "Couldn't subscribe to Home Assistant status\n")
+		}))
 	}
 	return
 }
+
+// waitFor waits for an mqtt operation to complete and returns its error.
+func waitFor(token MQTT.Token) error {
+	token.Wait()
+	return token.Error()
+}
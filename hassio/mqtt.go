@@ -8,14 +8,38 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"net/url"
+	"sync"
+	"sync/atomic"
 )
 
 type Client struct {
-	client                  MQTT.Client
-	Device                  *Device
-	uniqueDeviceId          string // optional. Duc's is used if not set
-	SensorConfigurationData map[string]SensorConfig
-	prefix                  string
+	client         MQTT.Client
+	Origin         *Origin
+	uniqueDeviceId string // optional. Duc's is used if not set
+
+	// mutex guards the device and the sensors, which are replaced while the mqtt client's own goroutines
+	// publish them, e.g. when it reconnects or Home Assistant restarts.
+	mutex  sync.RWMutex
+	device *Device
+	// sensorConfigs is never changed once set, only replaced.
+	sensorConfigs map[string]SensorConfig
+	// subscribed is set once SubscribeToHomeAssistantStatus has succeeded, so that the subscriptions are
+	// made again when reconnecting.
+	subscribed atomic.Bool
+
+	// DiagnosticConfigurationData are sensors about the bridge itself, published with SendDiagnosticData
+	DiagnosticConfigurationData map[string]SensorConfig
+	// Buttons are discovered along with the sensors. Presses are passed to OnButtonPressed
+	Buttons         []Button
+	OnButtonPressed func(buttonId string)
+	prefix          string
+	// serverUrl is the url of the mqtt server without credentials, for logging.
+	serverUrl string
+}
+
+// IsConnected is true if the connection to the mqtt server is currently up.
+func (hassioClient *Client) IsConnected() bool {
+	return hassioClient.client.IsConnected()
 }
 
 func onConnectionLost(_ MQTT.Client, err error) {
@@ -42,7 +66,32 @@ func (hassioClient *Client) sendMessage(topic string, payload interface{}) (err
 	return nil
 }
 
+// publishRetained publishes a plain text payload that the broker keeps for new subscribers.
+func (hassioClient *Client) publishRetained(topic string, payload string) error {
+	token := hassioClient.client.Publish(topic, 0, true, payload)
+	token.Wait()
+	if token.Error() != nil {
+		return eris.Wrapf(token.Error(), "Error publishing to topic %s\n", topic)
+	}
+	logger().Debug().Msgf("Message published to topic %s", topic)
+	return nil
+}
+
+// ConnectMqtt creates a client and connects it to the mqtt server.
 func ConnectMqtt(url url.URL, amqpVhost string, uniqueId string, prefix string) (hassioClient *Client, err error) {
+	hassioClient, err = NewClient(url, amqpVhost, uniqueId, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if err = hassioClient.Connect(); err != nil {
+		return nil, err
+	}
+	return hassioClient, nil
+}
+
+// NewClient creates a client without connecting it. Once Connect has succeeded, it reconnects by itself
+// whenever the connection is lost.
+func NewClient(url url.URL, amqpVhost string, uniqueId string, prefix string) (hassioClient *Client, err error) {
 	var password string
 	var hasPassword bool
 	if url.User == nil {
@@ -58,13 +107,13 @@ func ConnectMqtt(url url.URL, amqpVhost string, uniqueId string, prefix string)
 	}
 	urlCopy := url
 	urlCopy.User = nil
-	logger().Debug().Msgf("Connecting to mqtt server '%s'", urlCopy.String())
 
 	url.User = nil
 
 	hassioClient = &Client{
 		uniqueDeviceId: uniqueId,
 		prefix:         prefix,
+		serverUrl:      urlCopy.String(),
 	}
 	if prefix == "" {
 		hassioClient.prefix = "homeassistant"
@@ -72,7 +121,12 @@ func ConnectMqtt(url url.URL, amqpVhost string, uniqueId string, prefix string)
 
 	var onConnect MQTT.OnConnectHandler = func(_ MQTT.Client) {
 		logger().Info().Msg("MQTT connection established")
-		if hassioClient.Device != nil {
+		if hassioClient.subscribed.Load() {
+			if err := hassioClient.subscribe(); err != nil {
+				logger().Error().Err(err).Msg("Failed to subscribe to Home Assistant status again")
+			}
+		}
+		if hassioClient.hasDevice() {
 			err := hassioClient.SendLastWill()
 			if err != nil {
 				logger().Error().Err(err).Msg("Failed to write last will")
@@ -88,7 +142,6 @@ func ConnectMqtt(url url.URL, amqpVhost string, uniqueId string, prefix string)
 	opts := MQTT.NewClientOptions().AddBroker(url.String()).
 		SetClientID(url.User.Username()).
 		SetAutoReconnect(true).
-		SetConnectRetry(true).
 		SetConnectionLostHandler(onConnectionLost).
 		SetOnConnectHandler(onConnect).
 		SetPassword(password).
@@ -101,14 +154,17 @@ func ConnectMqtt(url url.URL, amqpVhost string, uniqueId string, prefix string)
 		opts.DefaultPublishHandler = messagePubHandler
 	}
 
-	// Create and start the client using the above options
-	client := MQTT.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		return nil, eris.Wrapf(token.Error(), "failed to connect to %s", url.String())
-	}
-	hassioClient.client = client
-
-	logger().Info().Msgf("Connected to mqtt server '%s'", urlCopy.String())
-
+	hassioClient.client = MQTT.NewClient(opts)
 	return
 }
+
+// Connect connects to the mqtt server. It fails right away if the server can't be reached, so that the
+// caller can decide how to retry.
+func (hassioClient *Client) Connect() error {
+	logger().Debug().Msgf("Connecting to mqtt server '%s'", hassioClient.serverUrl)
+	if token := hassioClient.client.Connect(); token.Wait() && token.Error() != nil {
+		return eris.Wrapf(token.Error(), "failed to connect to %s", hassioClient.serverUrl)
+	}
+	logger().Info().Msgf("Connected to mqtt server '%s'", hassioClient.serverUrl)
+	return nil
+}
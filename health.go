@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	hassio2 "github.com/SourceForgery/duc2mqtt/hassio"
+	"github.com/rotisserie/eris"
+	"net/http"
+	"time"
+)
+
+// ComponentStatus is the readiness of a single part of the bridge.
+type ComponentStatus struct {
+	Ready   bool   `json:"ready"`
+	Message string `json:"message,omitempty"`
+}
+
+// Readiness is the body of /readyz.
+type Readiness struct {
+	Ready      bool                       `json:"ready"`
+	Components map[string]ComponentStatus `json:"components"`
+}
+
+// healthChecker serves /healthz and /readyz.
+type healthChecker struct {
+	bridge       *bridge
+	hassioClient *hassio2.Client
+	// readyPollIntervals is how many intervals of the points polled most often may pass without a successful
+	// poll for the bridge to be ready.
+	readyPollIntervals int
+}
+
+func newHealthChecker(mux *http.ServeMux, bridge *bridge, hassioClient *hassio2.Client, readyPollIntervals int) *healthChecker {
+	checker := &healthChecker{
+		bridge:             bridge,
+		hassioClient:       hassioClient,
+		readyPollIntervals: readyPollIntervals,
+	}
+	mux.HandleFunc("GET /healthz", checker.healthz)
+	mux.HandleFunc("GET /readyz", checker.readyz)
+	return checker
+}
+
+func (checker *healthChecker) healthz(w http.ResponseWriter, _ *http.Request) {
+	writeJson(w, http.StatusOK, map[string]string{"status": "alive"})
+}
+
+func (checker *healthChecker) readiness() Readiness {
+	components := map[string]ComponentStatus{}
+
+	if checker.bridge.ducClient.SessionValid() {
+		components["ducSession"] = ComponentStatus{Ready: true}
+	} else {
+		components["ducSession"] = ComponentStatus{Message: "session rejected by the DUC"}
+	}
+
+	polling, lastSuccessfulPoll, lastPollError := checker.bridge.pollStatus()
+	// Some polls succeed at least as often as the points polled most often
+	maxPollAge := time.Duration(checker.readyPollIntervals) * checker.bridge.poller.ShortestPolledInterval()
+	switch {
+	case !polling:
+		components["poll"] = ComponentStatus{Ready: true, Message: "no points to poll"}
+	case lastSuccessfulPoll.IsZero():
+		components["poll"] = ComponentStatus{Message: "no successful poll yet"}
+	case time.Since(lastSuccessfulPoll) > maxPollAge:
+		message := fmt.Sprintf("last successful poll at %s", lastSuccessfulPoll.Format(time.RFC3339))
+		if lastPollError != nil {
+			message += ": " + lastPollError.Error()
+		}
+		components["poll"] = ComponentStatus{Message: message}
+	default:
+		components["poll"] = ComponentStatus{Ready: true, Message: lastSuccessfulPoll.Format(time.RFC3339)}
+	}
+
+	if checker.hassioClient != nil {
+		if checker.hassioClient.IsConnected() {
+			components["mqtt"] = ComponentStatus{Ready: true}
+		} else {
+			components["mqtt"] = ComponentStatus{Message: "not connected"}
+		}
+	}
+
+	readiness := Readiness{Ready: true, Components: components}
+	for _, component := range components {
+		readiness.Ready = readiness.Ready && component.Ready
+	}
+	return readiness
+}
+
+func (checker *healthChecker) readyz(w http.ResponseWriter, _ *http.Request) {
+	readiness := checker.readiness()
+	status := http.StatusOK
+	if !readiness.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJson(w, status, readiness)
+}
+
+// HealthcheckCommand queries /readyz of a running bridge, for container health checks
+// where there's no curl or wget available.
+type HealthcheckCommand struct {
+	Url string `long:"url" default:"http://localhost:8080/readyz" description:"Url to check"`
+}
+
+func (healthcheckCommand *HealthcheckCommand) run() error {
+	client := http.Client{Timeout: 5 * time.Second}
+	res, err := client.Get(healthcheckCommand.Url)
+	if err != nil {
+		return eris.Wrapf(err, "failed to reach %s", healthcheckCommand.Url)
+	}
+	defer res.Body.Close()
+	var readiness Readiness
+	_ = json.NewDecoder(res.Body).Decode(&readiness)
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("not ready (http %d): %v", res.StatusCode, readiness.Components)
+	}
+	return nil
+}
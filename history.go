@@ -0,0 +1,179 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/SourceForgery/duc2mqtt/bastec"
+	"github.com/rotisserie/eris"
+	"github.com/rs/zerolog/log"
+	_ "modernc.org/sqlite"
+	"net/url"
+	"time"
+)
+
+var _ Sink = (*historySink)(nil)
+
+// pruneInterval is how often samples older than the retention are deleted.
+const pruneInterval = time.Hour
+
+const historySchema = `
+CREATE TABLE IF NOT EXISTS points (
+	pid  TEXT PRIMARY KEY,
+	desc TEXT NOT NULL,
+	unit TEXT NOT NULL,
+	type TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS samples (
+	pid   TEXT    NOT NULL,
+	time  INTEGER NOT NULL,
+	value REAL    NOT NULL
+);
+CREATE INDEX IF NOT EXISTS samples_pid_time ON samples (pid, time);
+CREATE INDEX IF NOT EXISTS samples_time ON samples (time);
+`
+
+// HistoryConfig configures the local history database.
+type HistoryConfig struct {
+	Path          string `yaml:"path" json:"path"`
+	RetentionDays int    `yaml:"retentionDays" json:"retentionDays"`
+}
+
+// Sample is a single stored value of a point.
+type Sample struct {
+	Pid   string    `json:"pid"`
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+	Desc  string    `json:"desc,omitempty"`
+	Unit  string    `json:"unit,omitempty"`
+}
+
+// historyStore is a SQLite database with every polled value.
+type historyStore struct {
+	db *sql.DB
+}
+
+func openHistoryStore(path string) (*historyStore, error) {
+	if path == "" {
+		return nil, eris.New("no history path configured")
+	}
+	query := url.Values{}
+	query.Add("_pragma", "journal_mode(WAL)")
+	query.Add("_pragma", "busy_timeout(5000)")
+	db, err := sql.Open("sqlite", "file:"+path+"?"+query.Encode())
+	if err != nil {
+		return nil, eris.Wrapf(err, "failed to open history database %s", path)
+	}
+	if _, err = db.Exec(historySchema); err != nil {
+		_ = db.Close()
+		return nil, eris.Wrapf(err, "failed to create history tables in %s", path)
+	}
+	return &historyStore{db: db}, nil
+}
+
+func (store *historyStore) close() error {
+	return store.db.Close()
+}
+
+func (store *historyStore) savePoints(points []bastec.PointConfig) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return eris.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+	for _, point := range points {
+		_, err = tx.Exec(`INSERT INTO points (pid, desc, unit, type) VALUES (?, ?, ?, ?)
+			ON CONFLICT (pid) DO UPDATE SET desc = excluded.desc, unit = excluded.unit, type = excluded.type`,
+			point.Pid, point.Desc, point.Attr, point.Type)
+		if err != nil {
+			return eris.Wrapf(err, "failed to save point %s", point.Pid)
+		}
+	}
+	return tx.Commit()
+}
+
+func (store *historyStore) saveValues(timestamp time.Time, values []bastec.Point) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return eris.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+	for _, value := range values {
+		_, err = tx.Exec(`INSERT INTO samples (pid, time, value) VALUES (?, ?, ?)`, value.Pid, timestamp.Unix(), value.Value)
+		if err != nil {
+			return eris.Wrapf(err, "failed to save value of %s", value.Pid)
+		}
+	}
+	return tx.Commit()
+}
+
+// prune deletes all samples older than before.
+func (store *historyStore) prune(before time.Time) (deleted int64, err error) {
+	result, err := store.db.Exec(`DELETE FROM samples WHERE time < ?`, before.Unix())
+	if err != nil {
+		return 0, eris.Wrap(err, "failed to prune history")
+	}
+	return result.RowsAffected()
+}
+
+// samples returns the stored values of a point from since and on, oldest first.
+func (store *historyStore) samples(pid string, since time.Time) (samples []Sample, err error) {
+	rows, err := store.db.Query(`
+		SELECT s.time, s.value, COALESCE(p.desc, ''), COALESCE(p.unit, '')
+		FROM samples s LEFT JOIN points p ON p.pid = s.pid
+		WHERE s.pid = ? AND s.time >= ?
+		ORDER BY s.time`, pid, since.Unix())
+	if err != nil {
+		return nil, eris.Wrapf(err, "failed to query history of %s", pid)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		sample := Sample{Pid: pid}
+		var unixTime int64
+		if err = rows.Scan(&unixTime, &sample.Value, &sample.Desc, &sample.Unit); err != nil {
+			return nil, eris.Wrap(err, "failed to read history row")
+		}
+		sample.Time = time.Unix(unixTime, 0)
+		samples = append(samples, sample)
+	}
+	return samples, rows.Err()
+}
+
+// historySink stores every polled value in the local history database.
+type historySink struct {
+	store     *historyStore
+	retention time.Duration
+	lastPrune time.Time
+}
+
+func newHistorySink(config HistoryConfig) (*historySink, error) {
+	store, err := openHistoryStore(config.Path)
+	if err != nil {
+		return nil, err
+	}
+	return &historySink{
+		store:     store,
+		retention: time.Duration(config.RetentionDays) * 24 * time.Hour,
+	}, nil
+}
+
+func (sink *historySink) Name() string {
+	return "history"
+}
+
+func (sink *historySink) PublishPoints(points []bastec.PointConfig) error {
+	return sink.store.savePoints(points)
+}
+
+func (sink *historySink) PublishValues(timestamp time.Time, values []bastec.Point) error {
+	if err := sink.store.saveValues(timestamp, values); err != nil {
+		return err
+	}
+	if time.Since(sink.lastPrune) >= pruneInterval {
+		sink.lastPrune = time.Now()
+		deleted, err := sink.store.prune(time.Now().Add(-sink.retention))
+		if err != nil {
+			return err
+		}
+		log.Debug().Msgf("Pruned %d samples older than %d days from history", deleted, int(sink.retention.Hours()/24))
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/rotisserie/eris"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// HistoryCommand prints the stored values of a point from the local history database.
+type HistoryCommand struct {
+	Since  time.Duration `short:"s" long:"since" default:"24h" description:"How far back to go"`
+	Format string        `short:"f" long:"format" choice:"table" choice:"csv" choice:"json" default:"table" description:"Output format"`
+	Output string        `short:"o" long:"output" default:"-" description:"File to write to ('-' for stdout)"`
+	Args   struct {
+		Pid string `positional-arg-name:"pid" description:"DUC point id, e.g. 1.ai.1"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+func (historyCommand *HistoryCommand) run(config Config) (err error) {
+	store, err := openHistoryStore(config.History.Path)
+	if err != nil {
+		return err
+	}
+	defer store.close()
+
+	samples, err := store.samples(historyCommand.Args.Pid, time.Now().Add(-historyCommand.Since))
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if historyCommand.Output != "-" {
+		file, err := os.Create(historyCommand.Output)
+		if err != nil {
+			return eris.Wrapf(err, "failed to create %s", historyCommand.Output)
+		}
+		defer file.Close()
+		out = file
+	}
+	writer := bufio.NewWriter(out)
+
+	switch historyCommand.Format {
+	case "csv":
+		csvWriter := csv.NewWriter(writer)
+		_ = csvWriter.Write([]string{"time", "pid", "value", "desc", "unit"})
+		for _, sample := range samples {
+			_ = csvWriter.Write([]string{
+				sample.Time.Format(time.RFC3339),
+				sample.Pid,
+				strconv.FormatFloat(sample.Value, 'f', -1, 64),
+				sample.Desc,
+				sample.Unit,
+			})
+		}
+		csvWriter.Flush()
+		err = csvWriter.Error()
+	case "json":
+		if samples == nil {
+			samples = []Sample{}
+		}
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(samples)
+	default:
+		if len(samples) > 0 {
+			_, _ = fmt.Fprintf(writer, "%s: %s\n", samples[0].Pid, samples[0].Desc)
+		}
+		for _, sample := range samples {
+			_, _ = fmt.Fprintf(writer, "%s  %12s %s\n", sample.Time.Format(time.RFC3339), strconv.FormatFloat(sample.Value, 'f', -1, 64), sample.Unit)
+		}
+	}
+	if err != nil {
+		return eris.Wrap(err, "failed to write history")
+	}
+	if err = writer.Flush(); err != nil {
+		return eris.Wrap(err, "failed to write history")
+	}
+	return nil
+}
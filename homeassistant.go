@@ -0,0 +1,292 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/SourceForgery/duc2mqtt/bastec"
+	hassio2 "github.com/SourceForgery/duc2mqtt/hassio"
+	"github.com/rotisserie/eris"
+	"github.com/rs/zerolog/log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var _ Sink = (*homeAssistantSink)(nil)
+
+// errNotConnected is returned instead of publishing values before the mqtt server has been connected to.
+var errNotConnected = errors.New("not connected to the mqtt server yet")
+
+// homeAssistantSink publishes the points as Home Assistant MQTT discovery sensors.
+type homeAssistantSink struct {
+	hassioClient *hassio2.Client
+	bridge       *bridge
+	subscribed   bool
+	// connected is set once the mqtt server has been connected to. Until then, the sensors are only kept.
+	connected atomic.Bool
+	changes   *changeFilter
+}
+
+func newHomeAssistantSink(hassioClient *hassio2.Client, bridge *bridge) *homeAssistantSink {
+	sink := &homeAssistantSink{
+		hassioClient: hassioClient,
+		bridge:       bridge,
+		changes:      newChangeFilter(time.Duration(bridge.config.Mqtt.HeartbeatSeconds) * time.Second),
+	}
+	hassioClient.DiagnosticConfigurationData = map[string]hassio2.SensorConfig{
+		"last_poll":          hassio2.NewDiagnosticSensorConfig("last_poll", "Last successful poll", "timestamp", "", ""),
+		"poll_duration":      hassio2.NewDiagnosticSensorConfig("poll_duration", "Poll duration", "duration", "s", "measurement"),
+		"consecutive_errors": hassio2.NewDiagnosticSensorConfig("consecutive_errors", "Consecutive DUC errors", "", "", "measurement"),
+		"published_points":   hassio2.NewDiagnosticSensorConfig("published_points", "Published points", "", "", "measurement"),
+		"duc_firmware":       hassio2.NewDiagnosticSensorConfig("duc_firmware", "DUC firmware", "", "", ""),
+		"bridge_version":     hassio2.NewDiagnosticSensorConfig("bridge_version", "Bridge version", "", "", ""),
+		"uptime":             hassio2.NewDiagnosticSensorConfig("uptime", "Uptime", "duration", "s", ""),
+	}
+	hassioClient.Buttons = []hassio2.Button{
+		{Id: commandPollNow, Name: "Poll now"},
+		{Id: commandBrowse, Name: "Re-browse DUC"},
+		{Id: commandReconnectDuc, Name: "Reconnect DUC", DeviceClass: "restart"},
+	}
+	hassioClient.OnButtonPressed = bridge.command
+	go sink.publishDiagnosticsLoop(time.Duration(bridge.config.IntervalSeconds) * time.Second)
+	return sink
+}
+
+// connect connects to the mqtt server, retrying until it's up, and then publishes the sensors.
+func (sink *homeAssistantSink) connect(startup *startup) {
+	if err := startup.connect("the mqtt server", sink.hassioClient.Connect); err != nil {
+		log.Fatal().Err(err).Msg("Failed to connect to mqtt")
+	}
+	sink.connected.Store(true)
+	// The points published while connecting were only kept, they're sent along with subscribing
+	sink.bridge.republishPoints()
+}
+
+// publishDiagnosticsLoop publishes the diagnostics on its own schedule, so that they keep
+// being updated while polling the DUC fails.
+func (sink *homeAssistantSink) publishDiagnosticsLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if !sink.connected.Load() {
+			continue
+		}
+		diagnostics := sink.bridge.diagnostics()
+		states := map[string]string{
+			"poll_duration":      fmt.Sprintf("%.3f", diagnostics.PollDuration.Seconds()),
+			"consecutive_errors": strconv.Itoa(diagnostics.ConsecutiveErrors),
+			"published_points":   strconv.Itoa(diagnostics.PublishedPoints),
+			"duc_firmware":       diagnostics.DucFirmware,
+			"bridge_version":     diagnostics.Version,
+			"uptime":             strconv.FormatInt(int64(diagnostics.Uptime.Seconds()), 10),
+		}
+		// Left out until the first successful poll, which the sensor's template shows as unknown
+		if !diagnostics.LastSuccessfulPoll.IsZero() {
+			states["last_poll"] = diagnostics.LastSuccessfulPoll.Format(time.RFC3339)
+		}
+		if err := sink.hassioClient.SendDiagnosticData(states); err != nil {
+			mqttPublishErrors.Inc()
+			log.Error().Err(err).Msg("Failed to send diagnostics")
+		}
+	}
+}
+
+func (sink *homeAssistantSink) Name() string {
+	return "homeassistant"
+}
+
+func (sink *homeAssistantSink) PublishPoints(points []bastec.PointConfig) error {
+	sink.updateDevice()
+	sensorConfigs := map[string]hassio2.SensorConfig{}
+	for _, point := range points {
+		settings, _ := sink.bridge.settingsFor(point.Pid)
+		sensorConfig := sensorConfigFor(point, settings, sink.bridge.decimalsShownOf(point.Pid))
+		if sensorConfig == nil {
+			continue
+		}
+		log.Info().Msgf("Found sensor %s(converted to %s): %s", point.Pid, hassio2.MqttName(point.Pid), point.Desc)
+		sensorConfigs[point.Pid] = sensorConfig
+	}
+	previousSensorConfigs := sink.hassioClient.SetSensorConfigurations(sensorConfigs)
+	sink.changes.setPoints(points, sink.deadbandFor)
+
+	if !sink.connected.Load() {
+		return nil
+	}
+	if !sink.subscribed {
+		return sink.subscribe()
+	}
+	for pid, sensorConfig := range previousSensorConfigs {
+		if _, found := sensorConfigs[pid]; !found {
+			log.Info().Msgf("Removing sensor %s", pid)
+			if err := sink.hassioClient.SendConfigurationRemoval(sensorConfig); err != nil {
+				mqttPublishErrors.Inc()
+				return err
+			}
+		}
+	}
+	err := sink.hassioClient.SendConfigurationData()
+	if err != nil {
+		mqttPublishErrors.Inc()
+	}
+	return err
+}
+
+// deadbandFor returns the deadband of a point, as configured on the point or else for its unit.
+func (sink *homeAssistantSink) deadbandFor(point bastec.PointConfig) Deadband {
+	if settings, _ := sink.bridge.settingsFor(point.Pid); settings.Deadband != nil {
+		return *settings.Deadband
+	}
+	return sink.bridge.config.Mqtt.Deadbands[point.Attr]
+}
+
+// updateDevice fills in the device with what the DUC reports about itself.
+func (sink *homeAssistantSink) updateDevice() {
+	devId, ducVersion, session := sink.bridge.ducInfo()
+	device := sink.hassioClient.Device()
+	device.SerialNumber = devId
+	device.SWVersion = ducVersion.Firmware()
+	device.HWVersion = ducVersion.Hardware
+	device.Model = deviceModel(ducVersion, devId)
+	device.SuggestedArea = session.City
+	if sink.bridge.config.Mqtt.Name == "" {
+		device.Name = defaultDeviceName(session, devId)
+	}
+	sink.hassioClient.SetDevice(device)
+}
+
+// deviceModel is the hardware the DUC reports, or its device id if it doesn't report any.
+func deviceModel(ducVersion bastec.DucVersion, devId string) string {
+	if ducVersion.Hardware != "" {
+		return ducVersion.Hardware
+	}
+	if ducVersion.DevId != "" {
+		return ducVersion.DevId
+	}
+	return devId
+}
+
+// defaultDeviceName names the device after the site it's installed at, so that several DUCs can be told apart.
+func defaultDeviceName(session bastec.Session, devId string) string {
+	var parts []string
+	for _, part := range []string{session.Company, session.City} {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) > 0 {
+		return "DUC " + strings.Join(parts, " ")
+	}
+	if name := strings.TrimSpace(session.Name); name != "" {
+		return "DUC " + name
+	}
+	return strings.TrimSpace("DUC " + devId)
+}
+
+func (sink *homeAssistantSink) subscribe() error {
+	err := sink.hassioClient.SubscribeToHomeAssistantStatus()
+	if err != nil {
+		mqttPublishErrors.Inc()
+		return eris.Wrap(err, "failed to subscribe to Home Assistant status")
+	}
+	sink.subscribed = true
+	return nil
+}
+
+func (sink *homeAssistantSink) PublishValues(_ time.Time, values []bastec.Point) (err error) {
+	if !sink.connected.Load() {
+		return errNotConnected
+	}
+	if !sink.subscribed {
+		if err = sink.subscribe(); err != nil {
+			return
+		}
+	}
+
+	if err = sink.updateDecimals(values); err != nil {
+		return
+	}
+
+	now := time.Now()
+	changed := sink.changes.changed(now, values)
+	valuesToSend := make(map[string]string, len(changed))
+	for _, point := range changed {
+		sensorConfig := sink.hassioClient.SensorConfiguration(point.Pid)
+		if sensorConfig == nil {
+			continue
+		}
+		valuesToSend[point.Pid] = sensorConfig.ConvertValue(point.Value, point.Decimals)
+	}
+	err = sink.hassioClient.SendSensorData(valuesToSend)
+	if err != nil {
+		mqttPublishErrors.Inc()
+		return eris.Wrap(err, "failed to send sensor data")
+	}
+	sink.changes.markPublished(now, changed)
+	log.Info().Msgf("Successfully sent %d changed of %d polled values", len(valuesToSend), len(values))
+	return nil
+}
+
+// updateDecimals publishes the display precision of sensors again when the DUC shows their values with
+// another number of decimals than last known. The DUC only reports decimals along with values, so it
+// isn't known when the points are first published, unless it's cached from an earlier run.
+func (sink *homeAssistantSink) updateDecimals(values []bastec.Point) error {
+	for _, point := range values {
+		sensorConfig, isFloat := sink.hassioClient.SensorConfiguration(point.Pid).(*hassio2.FloatSensorConfig)
+		if !isFloat || sensorConfig.Decimals() == point.DecimalsShown {
+			continue
+		}
+		// The sensor is replaced rather than changed, as the mqtt client may be publishing it
+		sensorConfig = sensorConfig.WithDecimals(point.DecimalsShown)
+		sink.hassioClient.SetSensorConfiguration(sensorConfig)
+		if err := sink.hassioClient.SendSensorConfiguration(sensorConfig); err != nil {
+			mqttPublishErrors.Inc()
+			return eris.Wrapf(err, "failed to update the display precision of %s", point.Pid)
+		}
+	}
+	return nil
+}
+
+// sensorConfigFor maps a DUC point to a Home Assistant sensor, or nil if it can't be represented.
+// decimalsShown is -1 until the DUC has reported it.
+func sensorConfigFor(point bastec.PointConfig, settings PointSettings, decimalsShown int) hassio2.SensorConfig {
+	switch point.Type {
+	case "enum":
+		return hassio2.NewAlarmSensorConfig(point.Pid, point.Desc)
+	case "number":
+		deviceClass := ""
+		stateClass := "measurement"
+		switch point.Attr {
+		case "A":
+			deviceClass = "current"
+		case "V":
+			deviceClass = "voltage"
+		case "W":
+			deviceClass = "power"
+		case "kWh":
+			deviceClass = "energy"
+			stateClass = "total"
+		}
+		if settings.DeviceClass != "" {
+			deviceClass = settings.DeviceClass
+			if deviceClass == "energy" {
+				stateClass = "total"
+			}
+		}
+		if deviceClass == "" {
+			log.Warn().Msgf("Unknown device class for sensor %s: %s", point.Pid, point.Attr)
+			return nil
+		}
+		return hassio2.NewFloatSensorConfig(
+			point.Pid,
+			point.Desc,
+			deviceClass,
+			point.Attr,
+			stateClass,
+			decimalsShown,
+		)
+	default:
+		log.Warn().Msgf("Unknown device class for sensor %s: %s", point.Pid, point.Desc)
+		return nil
+	}
+}
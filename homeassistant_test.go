@@ -0,0 +1,23 @@
+package main
+
+import (
+	"github.com/SourceForgery/duc2mqtt/bastec"
+	"testing"
+)
+
+func TestDeviceModel(t *testing.T) {
+	for _, test := range []struct {
+		ducVersion bastec.DucVersion
+		devId      string
+		expected   string
+	}{
+		{bastec.DucVersion{Version: "2.3.4", Hardware: "BAS2 rev C", DevId: "DUC-1"}, "DUC-2", "BAS2 rev C"},
+		{bastec.DucVersion{Version: "2.3.4", DevId: "DUC-1"}, "DUC-2", "DUC-1"},
+		{bastec.DucVersion{Version: "2.3.4"}, "DUC-2", "DUC-2"},
+		{bastec.DucVersion{}, "", ""},
+	} {
+		if model := deviceModel(test.ducVersion, test.devId); model != test.expected {
+			t.Errorf("got the model %q of %+v and %q, expected %q", model, test.ducVersion, test.devId, test.expected)
+		}
+	}
+}
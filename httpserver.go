@@ -0,0 +1,30 @@
+package main
+
+import (
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"time"
+)
+
+// serveHttp runs the embedded HTTP server shared by everything the bridge serves over HTTP.
+func (config *Config) serveHttp(handler http.Handler) {
+	server := &http.Server{
+		Addr:              config.Http.Listen,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Info().Msgf("Listening for http on '%s'", config.Http.Listen)
+	err := server.ListenAndServe()
+	log.Fatal().Err(err).Msg("Http server failed")
+}
+
+// writeHandler serves a request that writes to the DUC or the configuration file, unless writes aren't allowed.
+// Nothing served over http is authenticated, so writing has to be enabled explicitly.
+func writeHandler(allowWrites bool, handler http.HandlerFunc) http.HandlerFunc {
+	if allowWrites {
+		return handler
+	}
+	return func(w http.ResponseWriter, _ *http.Request) {
+		writeJsonError(w, http.StatusForbidden, "writing is disabled, set http.allowWrites to enable it")
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/SourceForgery/duc2mqtt/bastec"
+	"github.com/rotisserie/eris"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var _ Sink = (*influxDbSink)(nil)
+
+// maxUdpPayload keeps the datagrams well below what InfluxDB's UDP listener accepts.
+const maxUdpPayload = 8192
+
+// InfluxDbConfig configures the influxdb sink.
+type InfluxDbConfig struct {
+	// Url is http(s)://host:8086 for the InfluxDB v2 write API, udp://host:8089 or file:///path/to/file.
+	Url         string `yaml:"url" json:"url"`
+	Org         string `yaml:"org" json:"org"`
+	Bucket      string `yaml:"bucket" json:"bucket"`
+	Token       string `yaml:"token" json:"token"`
+	Measurement string `yaml:"measurement" json:"measurement"`
+	// BatchSize is the number of lines collected before they're written.
+	BatchSize int `yaml:"batchSize" json:"batchSize"`
+	// FlushIntervalSeconds is the longest time lines are held back waiting for a full batch.
+	FlushIntervalSeconds int64 `yaml:"flushIntervalSeconds" json:"flushIntervalSeconds"`
+	// MaxRetries is how many extra attempts are made before a failed write is deferred to the next poll.
+	// Defaults to 3, negative disables retrying.
+	MaxRetries int `yaml:"maxRetries" json:"maxRetries"`
+	// MaxBufferedLines bounds the lines kept while InfluxDB is unreachable. The oldest are dropped first.
+	MaxBufferedLines int `yaml:"maxBufferedLines" json:"maxBufferedLines"`
+}
+
+type lineWriter interface {
+	write(lines []byte) error
+}
+
+// influxDbSink writes every polled value as InfluxDB line protocol.
+type influxDbSink struct {
+	config    InfluxDbConfig
+	writer    lineWriter
+	points    map[string]bastec.PointConfig
+	lines     [][]byte
+	lastFlush time.Time
+}
+
+func newInfluxDbSink(config InfluxDbConfig) (*influxDbSink, error) {
+	if config.Measurement == "" {
+		config.Measurement = "duc"
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 1000
+	}
+	if config.FlushIntervalSeconds <= 0 {
+		config.FlushIntervalSeconds = 60
+	}
+	if config.MaxRetries < 0 {
+		config.MaxRetries = 0
+	} else if config.MaxRetries == 0 {
+		config.MaxRetries = 3
+	}
+	if config.MaxBufferedLines <= 0 {
+		config.MaxBufferedLines = 100 * config.BatchSize
+	}
+
+	influxUrl, err := url.Parse(config.Url)
+	if err != nil {
+		return nil, eris.Wrap(err, "failed to parse influxdb url")
+	}
+
+	var writer lineWriter
+	switch influxUrl.Scheme {
+	case "http", "https":
+		writer, err = newInfluxHttpWriter(*influxUrl, config)
+	case "udp":
+		writer, err = newInfluxUdpWriter(influxUrl.Host)
+	case "file":
+		writer = &influxFileWriter{path: influxUrl.Path}
+	default:
+		err = fmt.Errorf("unsupported influxdb url scheme '%s'", influxUrl.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &influxDbSink{
+		config:    config,
+		writer:    writer,
+		points:    map[string]bastec.PointConfig{},
+		lastFlush: time.Now(),
+	}, nil
+}
+
+func (sink *influxDbSink) Name() string {
+	return "influxdb"
+}
+
+func (sink *influxDbSink) PublishPoints(points []bastec.PointConfig) error {
+	sink.points = make(map[string]bastec.PointConfig, len(points))
+	for _, point := range points {
+		sink.points[point.Pid] = point
+	}
+	return nil
+}
+
+func (sink *influxDbSink) PublishValues(timestamp time.Time, values []bastec.Point) error {
+	for _, value := range values {
+		sink.lines = append(sink.lines, sink.line(timestamp, value))
+	}
+	if dropped := len(sink.lines) - sink.config.MaxBufferedLines; dropped > 0 {
+		log.Warn().Msgf("Dropping %d lines not yet written to influxdb", dropped)
+		sink.lines = sink.lines[dropped:]
+	}
+
+	if len(sink.lines) < sink.config.BatchSize && time.Since(sink.lastFlush) < time.Duration(sink.config.FlushIntervalSeconds)*time.Second {
+		return nil
+	}
+	return sink.flush()
+}
+
+// flush writes all buffered lines in batches. Lines that couldn't be written are kept for the next attempt.
+func (sink *influxDbSink) flush() error {
+	sink.lastFlush = time.Now()
+	for len(sink.lines) > 0 {
+		batchSize := min(len(sink.lines), sink.config.BatchSize)
+		batch := bytes.Join(sink.lines[:batchSize], []byte{'\n'})
+		batch = append(batch, '\n')
+
+		var err error
+		for attempt := 0; attempt <= sink.config.MaxRetries; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+			if err = sink.writer.write(batch); err == nil {
+				break
+			}
+			log.Debug().Err(err).Msgf("Attempt %d to write to influxdb failed", attempt+1)
+		}
+		if err != nil {
+			return eris.Wrapf(err, "failed to write %d lines to influxdb", batchSize)
+		}
+		sink.lines = sink.lines[batchSize:]
+	}
+	sink.lines = nil
+	return nil
+}
+
+func (sink *influxDbSink) line(timestamp time.Time, value bastec.Point) []byte {
+	var line strings.Builder
+	line.WriteString(escapeInflux(sink.config.Measurement, ", "))
+	point := sink.points[value.Pid]
+	tags := [][2]string{{"pid", value.Pid}, {"desc", point.Desc}, {"unit", point.Attr}}
+	for _, tag := range tags {
+		if tag[1] == "" {
+			continue
+		}
+		line.WriteByte(',')
+		line.WriteString(tag[0])
+		line.WriteByte('=')
+		line.WriteString(escapeInflux(tag[1], ",= "))
+	}
+	line.WriteString(" value=")
+	line.WriteString(strconv.FormatFloat(value.Value, 'f', -1, 64))
+	line.WriteByte(' ')
+	line.WriteString(strconv.FormatInt(timestamp.UnixNano(), 10))
+	return []byte(line.String())
+}
+
+// escapeInflux backslash escapes the given characters as required by the line protocol.
+func escapeInflux(value string, chars string) string {
+	var escaped strings.Builder
+	for _, c := range value {
+		if c == '\n' {
+			c = ' '
+		}
+		if strings.ContainsRune(chars, c) {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteRune(c)
+	}
+	return escaped.String()
+}
+
+// influxHttpWriter uses the InfluxDB v2 write API.
+type influxHttpWriter struct {
+	client   *http.Client
+	writeUrl string
+	token    string
+}
+
+func newInfluxHttpWriter(influxUrl url.URL, config InfluxDbConfig) (*influxHttpWriter, error) {
+	if config.Org == "" || config.Bucket == "" {
+		return nil, eris.New("influxdb org and bucket are required for the http write api")
+	}
+	writeUrl := influxUrl.JoinPath("api/v2/write")
+	query := writeUrl.Query()
+	query.Set("org", config.Org)
+	query.Set("bucket", config.Bucket)
+	query.Set("precision", "ns")
+	writeUrl.RawQuery = query.Encode()
+	return &influxHttpWriter{
+		client:   &http.Client{Timeout: 30 * time.Second},
+		writeUrl: writeUrl.String(),
+		token:    config.Token,
+	}, nil
+}
+
+func (writer *influxHttpWriter) write(lines []byte) error {
+	req, err := http.NewRequest(http.MethodPost, writer.writeUrl, bytes.NewReader(lines))
+	if err != nil {
+		return eris.Wrap(err, "failed to create influxdb request")
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if writer.token != "" {
+		req.Header.Set("Authorization", "Token "+writer.token)
+	}
+	res, err := writer.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("influxdb http error code %d: %s", res.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// influxUdpWriter sends the lines to an InfluxDB UDP listener, split into datagrams on line boundaries.
+type influxUdpWriter struct {
+	conn net.Conn
+}
+
+func newInfluxUdpWriter(address string) (*influxUdpWriter, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, eris.Wrapf(err, "failed to open udp connection to %s", address)
+	}
+	return &influxUdpWriter{conn: conn}, nil
+}
+
+func (writer *influxUdpWriter) write(lines []byte) error {
+	for len(lines) > 0 {
+		size := len(lines)
+		if size > maxUdpPayload {
+			size = bytes.LastIndexByte(lines[:maxUdpPayload], '\n') + 1
+			if size == 0 {
+				size = maxUdpPayload
+			}
+		}
+		if _, err := writer.conn.Write(lines[:size]); err != nil {
+			return err
+		}
+		lines = lines[size:]
+	}
+	return nil
+}
+
+// influxFileWriter appends the lines to a file.
+type influxFileWriter struct {
+	path string
+}
+
+func (writer *influxFileWriter) write(lines []byte) error {
+	file, err := os.OpenFile(writer.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(lines); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
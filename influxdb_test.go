@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"github.com/SourceForgery/duc2mqtt/bastec"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEscapeInflux(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		chars    string
+		expected string
+	}{
+		{"duc", ", ", "duc"},
+		{"duc meter,1", ", ", `duc\ meter\,1`},
+		{"a=b", ",= ", `a\=b`},
+		{"a=b", ", ", "a=b"},
+		{"Outdoor temperature, north", ",= ", `Outdoor\ temperature\,\ north`},
+		{"two\nlines", ",= ", `two\ lines`},
+		{"°C", ",= ", "°C"},
+		{"", ",= ", ""},
+	} {
+		if escaped := escapeInflux(test.value, test.chars); escaped != test.expected {
+			t.Errorf("escaped %q as %q, expected %q", test.value, escaped, test.expected)
+		}
+	}
+}
+
+// newTestInfluxDbSink returns a sink writing to writer, with the points 1.ai.1 and 1.ai.2.
+func newTestInfluxDbSink(t *testing.T, config InfluxDbConfig, writer lineWriter) *influxDbSink {
+	t.Helper()
+	config.Url = "file://" + filepath.Join(t.TempDir(), "lines.lp")
+	sink, err := newInfluxDbSink(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.writer = writer
+	_ = sink.PublishPoints([]bastec.PointConfig{
+		{Pid: "1.ai.1", Desc: "Outdoor temperature, north", Attr: "°C"},
+		{Pid: "1.ai.2", Desc: "Supply air"},
+	})
+	return sink
+}
+
+func TestInfluxDbLine(t *testing.T) {
+	sink := newTestInfluxDbSink(t, InfluxDbConfig{Measurement: "duc meter"}, nil)
+	timestamp := time.Unix(1700000000, 5)
+	for value, expected := range map[bastec.Point]string{
+		{Pid: "1.ai.1", Value: 21.5}: `duc\ meter,pid=1.ai.1,desc=Outdoor\ temperature\,\ north,unit=°C value=21.5 1700000000000000005`,
+		{Pid: "1.ai.2", Value: -3}:   `duc\ meter,pid=1.ai.2,desc=Supply\ air value=-3 1700000000000000005`,
+		// Points that weren't published only have their pid
+		{Pid: "9.xx.1", Value: 1e-7}: `duc\ meter,pid=9.xx.1 value=0.0000001 1700000000000000005`,
+	} {
+		if line := string(sink.line(timestamp, value)); line != expected {
+			t.Errorf("got the line\n%s\nexpected\n%s", line, expected)
+		}
+	}
+}
+
+// fakeLineWriter records the batches written, and fails while failing is set.
+type fakeLineWriter struct {
+	failing  bool
+	attempts int
+	batches  []string
+}
+
+func (writer *fakeLineWriter) write(lines []byte) error {
+	writer.attempts++
+	if writer.failing {
+		return errors.New("connection refused")
+	}
+	writer.batches = append(writer.batches, string(lines))
+	return nil
+}
+
+func (writer *fakeLineWriter) lines() (lines []string) {
+	for _, batch := range writer.batches {
+		lines = append(lines, strings.Split(strings.TrimSuffix(batch, "\n"), "\n")...)
+	}
+	return
+}
+
+// values returns count values of a point without tags besides its pid.
+func values(count int) []bastec.Point {
+	points := make([]bastec.Point, count)
+	for i := range points {
+		points[i] = bastec.Point{Pid: "1.ai.9", Value: float64(i)}
+	}
+	return points
+}
+
+func TestInfluxDbSinkWritesFullBatches(t *testing.T) {
+	writer := &fakeLineWriter{}
+	sink := newTestInfluxDbSink(t, InfluxDbConfig{BatchSize: 4, FlushIntervalSeconds: 3600, MaxRetries: -1}, writer)
+
+	if err := sink.PublishValues(time.Now(), values(3)); err != nil || len(writer.batches) != 0 {
+		t.Fatalf("wrote %d batches and got %v before a batch was full", len(writer.batches), err)
+	}
+	if err := sink.PublishValues(time.Now(), values(6)); err != nil {
+		t.Fatal(err)
+	}
+	// All buffered lines are written, the last batch isn't full
+	if len(writer.batches) != 3 || len(writer.lines()) != 9 || len(sink.lines) != 0 {
+		t.Errorf("wrote %d lines in %d batches, kept %d, expected all 9 in 3 batches", len(writer.lines()), len(writer.batches), len(sink.lines))
+	}
+}
+
+func TestInfluxDbSinkKeepsTheNewestLinesWhileFailing(t *testing.T) {
+	writer := &fakeLineWriter{failing: true}
+	sink := newTestInfluxDbSink(t, InfluxDbConfig{BatchSize: 2, FlushIntervalSeconds: 3600, MaxRetries: -1, MaxBufferedLines: 5}, writer)
+
+	if err := sink.PublishValues(time.Now(), values(4)); err == nil {
+		t.Error("no error while influxdb is unreachable")
+	}
+	if err := sink.PublishValues(time.Now(), values(4)[2:]); err == nil {
+		t.Error("no error while influxdb is unreachable")
+	}
+	if len(sink.lines) != 5 {
+		t.Errorf("kept %d lines, expected at most 5", len(sink.lines))
+	}
+	if writer.attempts != 2 {
+		t.Errorf("made %d attempts without retries, expected one per flush", writer.attempts)
+	}
+
+	writer.failing = false
+	if err := sink.PublishValues(time.Now(), nil); err != nil {
+		t.Fatal(err)
+	}
+	var written []string
+	for _, line := range writer.lines() {
+		written = append(written, strings.Fields(line)[1])
+	}
+	// The oldest of the 6 lines was dropped
+	expected := "value=1 value=2 value=3 value=2 value=3"
+	if strings.Join(written, " ") != expected {
+		t.Errorf("wrote %v, expected %s", written, expected)
+	}
+}
+
+func TestInfluxDbSinkRetries(t *testing.T) {
+	writer := &fakeLineWriter{failing: true}
+	sink := newTestInfluxDbSink(t, InfluxDbConfig{BatchSize: 1, MaxRetries: 1}, writer)
+
+	if err := sink.PublishValues(time.Now(), values(1)); err == nil {
+		t.Error("no error after all attempts failed")
+	}
+	if writer.attempts != 2 {
+		t.Errorf("made %d attempts, expected 1 retry", writer.attempts)
+	}
+}
+
+func TestInfluxDbHttpWriter(t *testing.T) {
+	var query, authorization, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, authorization = r.URL.Query().Encode(), r.Header.Get("Authorization")
+		data, _ := io.ReadAll(r.Body)
+		body = string(data)
+		if r.URL.Path != "/api/v2/write" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sink, err := newInfluxDbSink(InfluxDbConfig{Url: server.URL, Org: "home", Bucket: "duc", Token: "secret", BatchSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.PublishValues(time.Unix(1, 0), []bastec.Point{{Pid: "1.ai.1", Value: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if query != "bucket=duc&org=home&precision=ns" || authorization != "Token secret" || body != "duc,pid=1.ai.1 value=2 1000000000\n" {
+		t.Errorf("wrote %q with the query %s and authorization %q", body, query, authorization)
+	}
+}
@@ -2,14 +2,18 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/SourceForgery/duc2mqtt/bastec"
 	hassio2 "github.com/SourceForgery/duc2mqtt/hassio"
 	"github.com/jessevdk/go-flags"
+	"github.com/rotisserie/eris"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"gopkg.in/yaml.v3"
+	"net/http"
 	"net/url"
 	"os"
 	"runtime/debug"
@@ -28,12 +32,50 @@ type Config struct {
 		UniqueId    string `yaml:"uniqueId" json:"uniqueId"`
 		TopicPrefix string `yaml:"topicPrefix" json:"topicPrefix"`
 		Name        string `yaml:"name" json:"name"`
+		// HeartbeatSeconds is the longest an unchanged value goes unpublished. Negative publishes every value on every poll.
+		HeartbeatSeconds int64 `yaml:"heartbeatSeconds" json:"heartbeatSeconds"`
+		// Deadbands are how much values of each unit must change to be published, unless set on the point.
+		Deadbands map[string]Deadband `yaml:"deadbands" json:"deadbands"`
 	} `yaml:"mqtt" json:"mqtt"`
 	Duc struct {
 		Url                string   `yaml:"url" json:"url"`
 		DisallowedPrefixes []string `yaml:"disallowedPrefixes" json:"disallowedPrefixes"`
+		// MaxPointsPerRequest splits polls into requests of at most this many points. 0 means no limit.
+		MaxPointsPerRequest int `yaml:"maxPointsPerRequest" json:"maxPointsPerRequest"`
+		// MaxConcurrentRequests is how many of the requests of a poll may be in flight at once.
+		MaxConcurrentRequests int `yaml:"maxConcurrentRequests" json:"maxConcurrentRequests"`
+		// StateFile is where the last good browse is cached. Defaults to duc2mqtt-state.json next to the configuration file.
+		StateFile string `yaml:"stateFile" json:"stateFile"`
 	} `yaml:"duc" json:"duc"`
 	IntervalSeconds int64 `yaml:"intervalSeconds" json:"intervalSeconds"`
+	// MaxStartupWaitSeconds is how long to keep retrying the DUC and the mqtt server at startup. 0 retries forever.
+	MaxStartupWaitSeconds int64 `yaml:"maxStartupWaitSeconds" json:"maxStartupWaitSeconds"`
+	// PollRates poll some points at other intervals than IntervalSeconds.
+	PollRates []PollRate      `yaml:"pollRates" json:"pollRates"`
+	Points    []PointSettings `yaml:"points" json:"points"`
+	Sinks     []string        `yaml:"sinks" json:"sinks"`
+	InfluxDb  InfluxDbConfig  `yaml:"influxdb" json:"influxdb"`
+	History   HistoryConfig   `yaml:"history" json:"history"`
+	Http      struct {
+		Listen string `yaml:"listen" json:"listen"`
+		// AllowWrites enables the endpoints that write to the DUC or the configuration file, which aren't authenticated.
+		AllowWrites bool `yaml:"allowWrites" json:"allowWrites"`
+		// Health enables /healthz and /readyz.
+		Health bool `yaml:"health" json:"health"`
+		// ReadyPollIntervals is how many poll intervals may pass without a successful poll before /readyz fails.
+		ReadyPollIntervals int `yaml:"readyPollIntervals" json:"readyPollIntervals"`
+	} `yaml:"http" json:"http"`
+}
+
+// PointSettings selects a DUC point for publishing and optionally overrides
+// what the DUC reports about it. If any points are configured, only those are published.
+type PointSettings struct {
+	Pid         string    `yaml:"pid" json:"pid"`
+	Name        string    `yaml:"name,omitempty" json:"name,omitempty"`
+	Unit        string    `yaml:"unit,omitempty" json:"unit,omitempty"`
+	DeviceClass string    `yaml:"deviceClass,omitempty" json:"deviceClass,omitempty"`
+	Disabled    bool      `yaml:"disabled,omitempty" json:"disabled,omitempty"`
+	Deadband    *Deadband `yaml:"deadband,omitempty" json:"deadband,omitempty"`
 }
 
 type Options struct {
@@ -46,17 +88,60 @@ type Options struct {
 
 func main() {
 	var opts Options
+	var initCommand InitCommand
+	var historyCommand HistoryCommand
+	var healthcheckCommand HealthcheckCommand
+	var rpcCommand RpcCommand
 
 	// Parse command-line options.
-	_, err := flags.Parse(&opts)
+	parser := flags.NewParser(&opts, flags.Default)
+	parser.SubcommandsOptional = true
+	_, err := parser.AddCommand("init", "Generate a starter config from a live DUC",
+		"Browses the DUC and writes a commented config with every point found, ready to be pruned.", &initCommand)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to register init command")
+	}
+	_, err = parser.AddCommand("history", "Print the stored history of a point",
+		"Prints or exports the values of a point stored by the history sink.", &historyCommand)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to register history command")
+	}
+	_, err = parser.AddCommand("healthcheck", "Check if a running bridge is ready",
+		"Exits with an error unless /readyz of a running bridge reports it as ready. Meant for container health checks.", &healthcheckCommand)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to register healthcheck command")
+	}
+	_, err = parser.AddCommand("rpc", "Send a JSON-RPC request to the DUC",
+		"Sends any JSON-RPC method with the given JSON parameters to the DUC and prints the result.", &rpcCommand)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to register rpc command")
+	}
+	_, err = parser.Parse()
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to parse command-line options")
 	}
 
-	config := parseConfig(opts)
-
 	initializeLogging(opts)
 
+	if parser.Active != nil {
+		switch parser.Active.Name {
+		case "init":
+			err = initCommand.run(opts)
+		case "history":
+			err = historyCommand.run(parseConfig(opts))
+		case "healthcheck":
+			err = healthcheckCommand.run()
+		case "rpc":
+			err = rpcCommand.run(parseConfig(opts))
+		}
+		if err != nil {
+			log.Fatal().Err(err).Msgf("%s failed", parser.Active.Name)
+		}
+		return
+	}
+
+	config := parseConfig(opts)
+
 	buildInfo, ok := debug.ReadBuildInfo()
 	if !ok {
 		log.Fatal().Msg("Failed to read build info")
@@ -82,159 +167,237 @@ func main() {
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to parse DUC URL")
 	}
-	ducClient, err := bastec.Connect(*ducUrl)
+	ducClient, err := bastec.NewClient(*ducUrl)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to connect to DUC")
+		log.Fatal().Err(err).Msg("Invalid DUC URL")
 	}
 
 	ducClient.DisallowedPrefixes = config.Duc.DisallowedPrefixes
+	ducClient.MaxPointsPerRequest = config.Duc.MaxPointsPerRequest
+	ducClient.MaxConcurrentRequests = config.Duc.MaxConcurrentRequests
+	registerDucTransportMetrics(ducClient)
 
+	bridge := newBridge(&config, opts.ConfigFile, ducClient)
+	bridgeVersion := version
+	if bridgeVersion == "unknown" {
+		bridgeVersion = buildInfo.Main.Version
+	}
+	bridge.version = fmt.Sprintf("%s (%s)", bridgeVersion, vcsVersion)
+	startup := newStartup(bridge.notifier, time.Duration(config.MaxStartupWaitSeconds)*time.Second)
+	httpMux := http.NewServeMux()
+	useHttp := false
+
+	var hassioClient *hassio2.Client
+	var homeAssistant *homeAssistantSink
+	var enabledSinks []Sink
+	for _, sinkName := range config.Sinks {
+		switch sinkName {
+		case "homeassistant":
+			hassioClient = config.newHomeAssistantClient(ducUrl, bridge.version)
+			homeAssistant = newHomeAssistantSink(hassioClient, bridge)
+			enabledSinks = append(enabledSinks, homeAssistant)
+		case "influxdb":
+			influxDbSink, err := newInfluxDbSink(config.InfluxDb)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to set up influxdb sink")
+			}
+			enabledSinks = append(enabledSinks, influxDbSink)
+		case "history":
+			historySink, err := newHistorySink(config.History)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to set up history sink")
+			}
+			enabledSinks = append(enabledSinks, historySink)
+		case "prometheus":
+			enabledSinks = append(enabledSinks, newPrometheusSink(httpMux, bridge.registry))
+			useHttp = true
+		case "api":
+			enabledSinks = append(enabledSinks, newApiSink(httpMux, ducClient, bridge.registry, config.Http.AllowWrites))
+			useHttp = true
+		case "webui":
+			enabledSinks = append(enabledSinks, newWebUiSink(httpMux, bridge))
+			useHttp = true
+		default:
+			log.Fatal().Msgf("Unknown sink '%s'", sinkName)
+		}
+	}
+	bridge.sinks = newSinks(bridge.valuesPublished, enabledSinks...)
+	if homeAssistant != nil {
+		// The DUC isn't kept waiting for the mqtt server, nor the other way around
+		go homeAssistant.connect(startup)
+	}
+
+	if config.Http.Health {
+		newHealthChecker(httpMux, bridge, hassioClient, config.Http.ReadyPollIntervals)
+		useHttp = true
+	}
+
+	if useHttp {
+		go config.serveHttp(httpMux)
+	}
+
+	// The sensors are published from the cache while waiting for the DUC
+	bridge.loadCache()
+	if err := startup.connect("the DUC", ducClient.Login); err != nil {
+		log.Fatal().Err(err).Msg("Failed to connect to DUC")
+	}
+	bridge.fetchDucVersion()
+	bridge.browse()
+	bridge.run()
+}
+
+func (config *Config) newHomeAssistantClient(ducUrl *url.URL, bridgeVersion string) *hassio2.Client {
 	mqttUrl, err := url.Parse(config.Mqtt.Url)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to parse mqtt url")
 	}
 
 	amqpVhost := strings.TrimPrefix(mqttUrl.Path, "/")
-	hassioClient, err := hassio2.ConnectMqtt(*mqttUrl, amqpVhost, config.Mqtt.UniqueId, config.Mqtt.TopicPrefix)
+	hassioClient, err := hassio2.NewClient(*mqttUrl, amqpVhost, config.Mqtt.UniqueId, config.Mqtt.TopicPrefix)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to connect to mqtt")
+		log.Fatal().Err(err).Msg("Invalid mqtt url")
 	}
 
-	hassioClient.Device = &hassio2.Device{
+	// The device is filled in with what the DUC reports about itself once it has been browsed
+	hassioClient.SetDevice(hassio2.Device{
 		Identifiers:      []string{config.Mqtt.UniqueId},
 		Name:             config.Mqtt.Name,
-		SWVersion:        buildInfo.Main.Version,
-		HWVersion:        "N/A",
-		SerialNumber:     "N/A",
-		Model:            "Duc2Mqtt",
-		ModelID:          "Duc2Mqtt",
-		Manufacturer:     "SourceForgery",
+		Manufacturer:     "Bastec",
 		ConfigurationURL: fmt.Sprintf("http://%s/config", ducUrl.Host),
+	})
+	hassioClient.Origin = &hassio2.Origin{
+		Name:       "duc2mqtt",
+		SWVersion:  bridgeVersion,
+		SupportURL: "https://github.com/SourceForgery/duc2mqtt",
 	}
+	return hassioClient
+}
 
-	hassioClient.SensorConfigurationData = fetchMqttDeviceConfig(ducClient)
-	err = hassioClient.SubscribeToHomeAssistantStatus()
+func parseConfig(opts Options) Config {
+	config, err := readConfig(opts.ConfigFile)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to subscribe to Home Assistant status")
+		log.Fatal().Err(err).Msg("Failed to parse configuration file")
 	}
-
-	config.publishValuesLoop(hassioClient, ducClient)
+	return config
 }
 
-func (config *Config) publishValuesLoop(hassioClient *hassio2.Client, ducClient *bastec.BastecClient) {
-	first := true
-	for {
-		if !first {
-			time.Sleep(time.Duration(config.IntervalSeconds) * time.Second)
-		}
-		first = false
-		var foo []string
-		for value := range hassioClient.SensorConfigurationData {
-			foo = append(foo, value)
-		}
-		values, err := ducClient.GetValues(foo)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Failed to get values")
-			continue
-		}
-		valuesToSend := make(map[string]map[string]string)
-
-		for _, point := range values.Result.Points {
-			sensorConfig := hassioClient.SensorConfigurationData[point.Pid]
-			if valuesToSend[sensorConfig.SensorType()] == nil {
-				valuesToSend[sensorConfig.SensorType()] = make(map[string]string)
-			}
-			valuesToSend[sensorConfig.SensorType()][point.Pid] = sensorConfig.ConvertValue(point.Value)
-		}
-		for sensorType, sensorValuesToSend := range valuesToSend {
-			err = hassioClient.SendSensorData(sensorType, sensorValuesToSend)
-			if err != nil {
-				log.Error().Err(err).Msg("Failed to send sensor data")
-			} else {
-				log.Info().Msg("Successfully sent sensor data")
-			}
-		}
+func readConfig(configFile string) (config Config, err error) {
+	// Load configuration from YAML file.
+	configData, err := os.ReadFile(configFile)
+	if err != nil {
+		return config, eris.Wrap(err, "failed to read configuration file")
 	}
-}
 
-func fetchMqttDeviceConfig(ducClient *bastec.BastecClient) map[string]hassio2.SensorConfig {
-	browse, err := ducClient.Browse()
+	if strings.HasSuffix(configFile, "yaml") {
+		err = yaml.Unmarshal(configData, &config)
+	} else if strings.HasSuffix(configFile, "json") {
+		err = json.Unmarshal(configData, &config)
+	} else {
+		err = fmt.Errorf("unknown file extension: %s", configFile)
+	}
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to browse")
+		return config, err
 	}
 
-	sensorConfigs := map[string]hassio2.SensorConfig{}
-device:
-	for _, point := range browse.Result.Points {
-
-		for _, prefix := range ducClient.DisallowedPrefixes {
-			if strings.HasPrefix(point.Pid, prefix) {
-				log.Debug().Msgf("Skipping sensor %s: %s", point.Pid, point.Desc)
-				continue device
-			}
-		}
-
-		var sensorConfig hassio2.SensorConfig
-		switch point.Type {
-		case "enum":
-			sensorConfig = hassio2.NewAlarmSensorConfig(point.Pid, point.Desc)
-		case "number":
-			deviceClass := ""
-			stateClass := "measurement"
-			switch point.Attr {
-			case "A":
-				deviceClass = "current"
-			case "V":
-				deviceClass = "voltage"
-			case "W":
-				deviceClass = "power"
-			case "kWh":
-				deviceClass = "energy"
-				stateClass = "total"
-			default:
-				log.Warn().Msgf("Unknown device class for sensor %s: %s", point.Pid, point.Attr)
-				continue device
-			}
-			sensorConfig = hassio2.NewFloatSensorConfig(
-				point.Pid,
-				point.Desc,
-				deviceClass,
-				point.Attr,
-				stateClass,
-			)
-		default:
-			log.Warn().Msgf("Unknown device class for sensor %s: %s", point.Pid, point.Desc)
-			continue
-		}
-		log.Info().Msgf("Found sensor %s(converted to %s): %s", point.Pid, hassio2.MqttName(point.Pid), point.Desc)
-		sensorConfigs[point.Pid] = sensorConfig
+	if config.IntervalSeconds == 0 {
+		config.IntervalSeconds = 10
 	}
-	return sensorConfigs
+	if config.Mqtt.HeartbeatSeconds == 0 {
+		config.Mqtt.HeartbeatSeconds = defaultHeartbeatSeconds
+	}
+	if len(config.Sinks) == 0 {
+		config.Sinks = []string{"homeassistant"}
+	}
+	if config.History.RetentionDays == 0 {
+		config.History.RetentionDays = 30
+	}
+	if config.Http.Listen == "" {
+		config.Http.Listen = "127.0.0.1:8080"
+	}
+	if config.Http.ReadyPollIntervals == 0 {
+		config.Http.ReadyPollIntervals = 3
+	}
+	return config, nil
 }
 
-func parseConfig(opts Options) Config {
-	// Load configuration from YAML file.
-	configData, err := os.ReadFile(opts.ConfigFile)
+// savePointSettings replaces the points in the configuration file, keeping everything else as is.
+func savePointSettings(configFile string, points []PointSettings) (err error) {
+	configData, err := os.ReadFile(configFile)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to read configuration file")
+		return eris.Wrap(err, "failed to read configuration file")
 	}
 
-	var config Config
-	if strings.HasSuffix(opts.ConfigFile, "yaml") {
-		err = yaml.Unmarshal(configData, &config)
-	} else if strings.HasSuffix(opts.ConfigFile, "json") {
-		err = json.Unmarshal(configData, &config)
+	if strings.HasSuffix(configFile, "yaml") {
+		configData, err = replaceYamlPoints(configData, points)
+	} else if strings.HasSuffix(configFile, "json") {
+		configData, err = replaceJsonPoints(configData, points)
 	} else {
-		err = fmt.Errorf("unknown file extension: %s", opts.ConfigFile)
+		err = fmt.Errorf("unknown file extension: %s", configFile)
 	}
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to parse configuration file")
+		return eris.Wrap(err, "failed to update configuration")
 	}
 
-	if config.IntervalSeconds == 0 {
-		config.IntervalSeconds = 10
+	// Write to a temporary file first, so a failed write can't leave a truncated configuration behind.
+	tempFile := configFile + ".tmp"
+	if err = os.WriteFile(tempFile, configData, 0600); err != nil {
+		return eris.Wrap(err, "failed to write configuration file")
 	}
-	return config
+	if err = os.Rename(tempFile, configFile); err != nil {
+		return eris.Wrap(err, "failed to replace configuration file")
+	}
+	return nil
+}
+
+// replaceYamlPoints replaces the points node only, so that comments elsewhere in the file are kept.
+func replaceYamlPoints(configData []byte, points []PointSettings) ([]byte, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(configData, &document); err != nil {
+		return nil, err
+	}
+	if len(document.Content) == 0 {
+		document = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, errors.New("configuration is not a yaml mapping")
+	}
+
+	var pointsNode yaml.Node
+	if err := pointsNode.Encode(points); err != nil {
+		return nil, err
+	}
+	replaced := false
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "points" {
+			root.Content[i+1] = &pointsNode
+			replaced = true
+		}
+	}
+	if !replaced {
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: "points"}, &pointsNode)
+	}
+
+	var buffer bytes.Buffer
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&document); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), encoder.Close()
+}
+
+func replaceJsonPoints(configData []byte, points []PointSettings) ([]byte, error) {
+	var document map[string]json.RawMessage
+	if err := json.Unmarshal(configData, &document); err != nil {
+		return nil, err
+	}
+	pointsJson, err := json.Marshal(points)
+	if err != nil {
+		return nil, err
+	}
+	document["points"] = pointsJson
+	return json.MarshalIndent(document, "", "  ")
 }
 
 func initializeLogging(opts Options) {
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/SourceForgery/duc2mqtt/bastec"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The bridge's own metrics. They're always recorded, but only exposed if the prometheus sink is enabled.
+var (
+	pollDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "duc2mqtt_poll_duration_seconds",
+		Help:    "Time taken to fetch the values from the DUC.",
+		Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	})
+	ducRequestErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "duc2mqtt_duc_request_errors_total",
+		Help: "Number of failed requests to the DUC.",
+	})
+	mqttPublishErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "duc2mqtt_mqtt_publish_errors_total",
+		Help: "Number of failed publishes to the MQTT server.",
+	})
+	lastSuccessfulPoll = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "duc2mqtt_last_successful_poll_timestamp_seconds",
+		Help: "Unix time of the last successful poll of the DUC.",
+	})
+	publishedPoints = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "duc2mqtt_published_points",
+		Help: "Number of points published by the last poll.",
+	})
+)
+
+// registerDucTransportMetrics exposes how the connections to the DUC are used, e.g. to see that they're reused.
+func registerDucTransportMetrics(ducClient *bastec.BastecClient) {
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "duc2mqtt_duc_http_requests_total",
+		Help: "Number of http requests sent to the DUC.",
+	}, func() float64 { return float64(ducClient.TransportStats().Requests) })
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "duc2mqtt_duc_connections_opened_total",
+		Help: "Number of connections opened to the DUC.",
+	}, func() float64 { return float64(ducClient.TransportStats().ConnectionsOpened) })
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "duc2mqtt_duc_connections_reused_total",
+		Help: "Number of requests to the DUC that reused an idle connection.",
+	}, func() float64 { return float64(ducClient.TransportStats().ConnectionsReused) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "duc2mqtt_duc_open_connections",
+		Help: "Number of connections to the DUC that are open right now.",
+	}, func() float64 { return float64(ducClient.TransportStats().OpenConnections) })
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"github.com/SourceForgery/duc2mqtt/bastec"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var _ Sink = (*prometheusSink)(nil)
+var _ prometheus.Collector = (*prometheusSink)(nil)
+
+var pointLabels = []string{"pid", "description", "unit", "type"}
+
+var (
+	pointValueDesc = prometheus.NewDesc(
+		"duc_point_value",
+		"Latest value of a DUC point.",
+		pointLabels, nil,
+	)
+	pointTotalDesc = prometheus.NewDesc(
+		"duc_point_total",
+		"Latest value of an ever increasing DUC point, e.g. an energy meter.",
+		pointLabels, nil,
+	)
+)
+
+// prometheusSink exposes the latest value of every polled point, from the registry, on /metrics.
+type prometheusSink struct {
+	registry *bastec.PointRegistry
+	mutex    sync.Mutex
+	points   []bastec.PointConfig
+}
+
+func newPrometheusSink(mux *http.ServeMux, registry *bastec.PointRegistry) *prometheusSink {
+	sink := &prometheusSink{
+		registry: registry,
+	}
+	prometheus.MustRegister(sink)
+	mux.Handle("/metrics", promhttp.Handler())
+	return sink
+}
+
+func (sink *prometheusSink) Name() string {
+	return "prometheus"
+}
+
+func (sink *prometheusSink) PublishPoints(points []bastec.PointConfig) error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	sink.points = points
+	return nil
+}
+
+// PublishValues does nothing, the values are collected from the registry.
+func (sink *prometheusSink) PublishValues(_ time.Time, _ []bastec.Point) error {
+	return nil
+}
+
+func (sink *prometheusSink) Describe(descs chan<- *prometheus.Desc) {
+	descs <- pointValueDesc
+	descs <- pointTotalDesc
+}
+
+func (sink *prometheusSink) Collect(metrics chan<- prometheus.Metric) {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	for _, point := range sink.points {
+		registeredPoint, found := sink.registry.Point(point.Pid)
+		if !found || !registeredPoint.HasValue {
+			continue
+		}
+		value := registeredPoint.Value
+		desc, valueType := pointValueDesc, prometheus.GaugeValue
+		if point.Attr == "kWh" {
+			desc, valueType = pointTotalDesc, prometheus.CounterValue
+		}
+		metrics <- prometheus.MustNewConstMetric(desc, valueType, value, point.Pid, point.Desc, point.Attr, point.Type)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/SourceForgery/duc2mqtt/bastec"
+	"github.com/rotisserie/eris"
+	"net/url"
+	"os"
+	"time"
+)
+
+// RpcCommand sends any JSON-RPC method to the DUC and prints the result, to explore methods the bridge doesn't use.
+type RpcCommand struct {
+	Timeout time.Duration `short:"t" long:"timeout" default:"30s" description:"How long to wait for the DUC"`
+	Args    struct {
+		Method string `positional-arg-name:"method" description:"JSON-RPC method, e.g. pdb.browse" required:"yes"`
+		Params string `positional-arg-name:"params" description:"Parameters as JSON, e.g. '[[\"1.ai.1\"]]'"`
+	} `positional-args:"yes"`
+}
+
+func (rpcCommand *RpcCommand) run(config Config) error {
+	var params any
+	if rpcCommand.Args.Params != "" {
+		var rawParams json.RawMessage
+		if err := json.Unmarshal([]byte(rpcCommand.Args.Params), &rawParams); err != nil {
+			return eris.Wrap(err, "params must be valid JSON")
+		}
+		params = rawParams
+	}
+
+	ducUrl, err := url.Parse(config.Duc.Url)
+	if err != nil {
+		return eris.Wrap(err, "failed to parse DUC URL")
+	}
+	ducClient, err := bastec.Connect(*ducUrl)
+	if err != nil {
+		return eris.Wrap(err, "failed to connect to DUC")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rpcCommand.Timeout)
+	defer cancel()
+	var result json.RawMessage
+	if err = ducClient.Call(ctx, rpcCommand.Args.Method, params, &result); err != nil {
+		return err
+	}
+
+	var indented bytes.Buffer
+	if len(result) == 0 || json.Indent(&indented, result, "", "  ") != nil {
+		indented.Reset()
+		indented.Write(result)
+	}
+	_, err = fmt.Fprintln(os.Stdout, indented.String())
+	return err
+}
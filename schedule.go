@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/SourceForgery/duc2mqtt/bastec"
+	"path"
+	"time"
+)
+
+// PollRate polls the points it matches at another interval than intervalSeconds.
+// A rule matches a point if all of its set fields match. The first matching rule is used.
+type PollRate struct {
+	// Pid is a pattern as in path.Match, e.g. "1.em.*"
+	Pid string `yaml:"pid,omitempty" json:"pid,omitempty"`
+	// Unit is the unit of the point, after any override in points.
+	Unit            string `yaml:"unit,omitempty" json:"unit,omitempty"`
+	IntervalSeconds int64  `yaml:"intervalSeconds" json:"intervalSeconds"`
+}
+
+func (rate PollRate) matches(point bastec.PointConfig) bool {
+	if rate.Pid != "" {
+		if matched, _ := path.Match(rate.Pid, point.Pid); !matched {
+			return false
+		}
+	}
+	return rate.Unit == "" || rate.Unit == point.Attr
+}
+
+// pollIntervals returns how often each point is to be polled according to the rates, or 0 for the default interval.
+func pollIntervals(points []bastec.PointConfig, rates []PollRate) map[string]time.Duration {
+	intervals := make(map[string]time.Duration, len(points))
+	for _, point := range points {
+		for _, rate := range rates {
+			if rate.IntervalSeconds > 0 && rate.matches(point) {
+				intervals[point.Pid] = time.Duration(rate.IntervalSeconds) * time.Second
+				break
+			}
+		}
+	}
+	return intervals
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/SourceForgery/duc2mqtt/bastec"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+// maxQueuedValueBatches is how many polls a slow sink may fall behind before the oldest are dropped.
+const maxQueuedValueBatches = 32
+
+// Sink is an output backend for what the bridge reads from the DUC.
+type Sink interface {
+	// Name identifies the sink in logs and configuration.
+	Name() string
+	// PublishPoints is called with the metadata of every polled point, at startup and whenever the DUC is browsed again.
+	PublishPoints(points []bastec.PointConfig) error
+	// PublishValues is called with every batch of polled values and the DUC's time for them.
+	PublishValues(timestamp time.Time, values []bastec.Point) error
+}
+
+type valueBatch struct {
+	timestamp time.Time
+	values    []bastec.Point
+}
+
+// sinkRunner feeds a single sink from its own goroutine, so a slow or failing sink
+// can't hold up the poll loop or the other sinks.
+type sinkRunner struct {
+	sinks  *Sinks
+	sink   Sink
+	mutex  sync.Mutex
+	points []bastec.PointConfig
+	// pointsPending is set when points haven't been handed to the sink yet. They may be empty,
+	// e.g. when every point has been unticked in the web ui.
+	pointsPending bool
+	batches       []valueBatch
+	wakeup        chan struct{}
+}
+
+// Sinks fans out everything the bridge reads to all enabled sinks.
+type Sinks struct {
+	runners []*sinkRunner
+	// onValuesPublished is called whenever a sink has successfully published a batch of values.
+	onValuesPublished func(sink Sink)
+}
+
+func newSinks(onValuesPublished func(sink Sink), sinks ...Sink) *Sinks {
+	s := &Sinks{onValuesPublished: onValuesPublished}
+	for _, sink := range sinks {
+		runner := &sinkRunner{
+			sinks:  s,
+			sink:   sink,
+			wakeup: make(chan struct{}, 1),
+		}
+		s.runners = append(s.runners, runner)
+		go runner.run()
+	}
+	return s
+}
+
+// PublishPoints queues the point metadata for every sink. Only the latest metadata is kept
+// for sinks that haven't caught up yet.
+func (s *Sinks) PublishPoints(points []bastec.PointConfig) {
+	for _, runner := range s.runners {
+		runner.mutex.Lock()
+		runner.points = points
+		runner.pointsPending = true
+		runner.mutex.Unlock()
+		runner.notify()
+	}
+}
+
+// PublishValues queues a batch of values for every sink.
+func (s *Sinks) PublishValues(timestamp time.Time, values []bastec.Point) {
+	for _, runner := range s.runners {
+		runner.mutex.Lock()
+		if len(runner.batches) >= maxQueuedValueBatches {
+			log.Warn().Msgf("Sink %s is falling behind, dropping values from %s", runner.sink.Name(), runner.batches[0].timestamp)
+			runner.batches = runner.batches[1:]
+		}
+		runner.batches = append(runner.batches, valueBatch{timestamp: timestamp, values: values})
+		runner.mutex.Unlock()
+		runner.notify()
+	}
+}
+
+func (runner *sinkRunner) notify() {
+	select {
+	case runner.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (runner *sinkRunner) run() {
+	for range runner.wakeup {
+		runner.mutex.Lock()
+		points := runner.points
+		pointsPending := runner.pointsPending
+		batches := runner.batches
+		runner.points = nil
+		runner.pointsPending = false
+		runner.batches = nil
+		runner.mutex.Unlock()
+
+		if pointsPending {
+			runner.call("publish points", func() error {
+				return runner.sink.PublishPoints(points)
+			})
+		}
+		for _, batch := range batches {
+			published := runner.call("publish values", func() error {
+				return runner.sink.PublishValues(batch.timestamp, batch.values)
+			})
+			if published && runner.sinks.onValuesPublished != nil {
+				runner.sinks.onValuesPublished(runner.sink)
+			}
+		}
+	}
+}
+
+// call runs a single sink operation, logging instead of propagating any error or panic.
+func (runner *sinkRunner) call(operation string, f func() error) (success bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error().Err(fmt.Errorf("%v", r)).Msgf("Sink %s panicked during %s", runner.sink.Name(), operation)
+			success = false
+		}
+	}()
+	err := f()
+	if errors.Is(err, errNotConnected) {
+		// Expected while waiting for the sink's server at startup, which is logged elsewhere
+		log.Debug().Err(err).Msgf("Sink %s didn't %s", runner.sink.Name(), operation)
+		return false
+	}
+	if err != nil {
+		log.Error().Err(err).Msgf("Sink %s failed to %s", runner.sink.Name(), operation)
+		return false
+	}
+	return true
+}
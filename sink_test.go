@@ -0,0 +1,59 @@
+package main
+
+import (
+	"github.com/SourceForgery/duc2mqtt/bastec"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeSink fails to publish values until it's connected.
+type fakeSink struct {
+	connected atomic.Bool
+	published chan int
+}
+
+func (sink *fakeSink) Name() string {
+	return "fake"
+}
+
+func (sink *fakeSink) PublishPoints(_ []bastec.PointConfig) error {
+	return nil
+}
+
+func (sink *fakeSink) PublishValues(_ time.Time, values []bastec.Point) error {
+	if !sink.connected.Load() {
+		return errNotConnected
+	}
+	sink.published <- len(values)
+	return nil
+}
+
+func TestValuesArePublishedOnlyOnceConnected(t *testing.T) {
+	sink := &fakeSink{published: make(chan int, 1)}
+	onValuesPublished := make(chan Sink, 4)
+	sinks := newSinks(func(sink Sink) { onValuesPublished <- sink }, sink)
+
+	sinks.PublishValues(time.Now(), []bastec.Point{{Pid: "1.ai.1"}})
+	select {
+	case <-onValuesPublished:
+		t.Fatal("values reported as published before the sink was connected")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	sink.connected.Store(true)
+	sinks.PublishValues(time.Now(), []bastec.Point{{Pid: "1.ai.1"}, {Pid: "1.ai.2"}})
+	select {
+	case count := <-sink.published:
+		if count != 2 {
+			t.Errorf("published %d values, expected 2", count)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("values not published once connected")
+	}
+	select {
+	case <-onValuesPublished:
+	case <-time.After(time.Second):
+		t.Fatal("values not reported as published once connected")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/SourceForgery/duc2mqtt/bastec"
+	"github.com/rotisserie/eris"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// The wait between connection attempts at startup doubles from initialConnectBackoff up to maxConnectBackoff.
+const (
+	initialConnectBackoff = time.Second
+	maxConnectBackoff     = time.Minute
+	// connectAttemptTimeout is how long a single attempt may take, for extending the startup timeout of systemd.
+	connectAttemptTimeout = 30 * time.Second
+)
+
+// startup retries the connections to the DUC and the mqtt server, which are often not up yet when the
+// bridge starts, e.g. after a power outage.
+type startup struct {
+	notifier *systemdNotifier
+	// deadline is when to give up. Zero retries forever.
+	deadline time.Time
+}
+
+func newStartup(notifier *systemdNotifier, maxWait time.Duration) *startup {
+	startup := &startup{notifier: notifier}
+	if maxWait > 0 {
+		startup.deadline = time.Now().Add(maxWait)
+	}
+	return startup
+}
+
+// connect calls connect until it succeeds, waiting longer and longer between the attempts.
+// It returns the last error if the deadline would pass before the next attempt, and right away if the
+// credentials are wrong, as retrying won't help.
+func (startup *startup) connect(what string, connect func() error) error {
+	backoff := initialConnectBackoff
+	for attempt := 1; ; attempt++ {
+		startup.notifier.status(fmt.Sprintf("Connecting to %s", what))
+		err := connect()
+		if err == nil {
+			if attempt > 1 {
+				log.Info().Msgf("Connected to %s after %d attempts", what, attempt)
+			}
+			return nil
+		}
+		if errors.Is(err, bastec.ErrAuthFailed) {
+			return eris.Wrapf(err, "failed to log in to %s", what)
+		}
+		if !startup.deadline.IsZero() && time.Now().Add(backoff).After(startup.deadline) {
+			return eris.Wrapf(err, "gave up connecting to %s after %d attempts", what, attempt)
+		}
+		log.Warn().Err(err).Msgf("Failed to connect to %s (attempt %d), retrying in %s", what, attempt, backoff)
+		startup.notifier.status(fmt.Sprintf("Waiting for %s, attempt %d failed: %s", what, attempt, err))
+		startup.notifier.extendStartTimeout(backoff + connectAttemptTimeout)
+		// Waiting is expected, it shouldn't look like a hang to the watchdog
+		startup.notifier.watchdog()
+		time.Sleep(backoff)
+		backoff = min(2*backoff, maxConnectBackoff)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"github.com/SourceForgery/duc2mqtt/bastec"
+	"testing"
+	"time"
+)
+
+func TestStartupGivesUpOnWrongCredentials(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	startup := newStartup(newSystemdNotifier(), 0)
+	attempts := 0
+	err := startup.connect("the DUC", func() error {
+		attempts++
+		return bastec.ErrWrongPassword
+	})
+	if !errors.Is(err, bastec.ErrAuthFailed) || attempts != 1 {
+		t.Errorf("got %v after %d attempts, expected to give up after the first", err, attempts)
+	}
+}
+
+func TestStartupRetriesUntilConnected(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	startup := newStartup(newSystemdNotifier(), time.Minute)
+	attempts := 0
+	err := startup.connect("the DUC", func() error {
+		attempts++
+		if attempts == 1 {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	if err != nil || attempts != 2 {
+		t.Errorf("got %v after %d attempts, expected to connect at the second", err, attempts)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"github.com/rotisserie/eris"
+	"github.com/rs/zerolog/log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// systemdNotifier implements the sd_notify protocol. All methods are no-ops unless
+// systemd passed a NOTIFY_SOCKET, i.e. the service is Type=notify.
+type systemdNotifier struct {
+	conn             *net.UnixConn
+	watchdogInterval time.Duration
+	readyOnce        sync.Once
+}
+
+func newSystemdNotifier() *systemdNotifier {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return &systemdNotifier{}
+	}
+	// Abstract namespace sockets are given with a leading '@'
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to connect to systemd notify socket %s", socket)
+		return &systemdNotifier{}
+	}
+	notifier := &systemdNotifier{conn: conn}
+
+	if watchdogUsec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64); err == nil && watchdogUsec > 0 {
+		notifier.watchdogInterval = time.Duration(watchdogUsec) * time.Microsecond
+	}
+	log.Debug().Msgf("Notifying systemd on %s, watchdog interval %s", socket, notifier.watchdogInterval)
+	return notifier
+}
+
+func (notifier *systemdNotifier) notify(state string) {
+	if notifier.conn == nil {
+		return
+	}
+	if _, err := notifier.conn.Write([]byte(state)); err != nil {
+		log.Warn().Err(eris.Wrap(err, "failed to notify systemd")).Msgf("Failed to send '%s' to systemd", state)
+	}
+}
+
+// checkWatchdog warns if the watchdog would fire between two polls.
+func (notifier *systemdNotifier) checkWatchdog(pollInterval time.Duration) {
+	if notifier.watchdogInterval > 0 && notifier.watchdogInterval < 2*pollInterval {
+		log.Warn().Msgf("WatchdogSec=%s is too short for a poll interval of %s, it should be at least twice as long",
+			notifier.watchdogInterval, pollInterval)
+	}
+}
+
+// ready tells systemd that the bridge has started. Only the first call has any effect.
+func (notifier *systemdNotifier) ready() {
+	notifier.readyOnce.Do(func() {
+		notifier.notify("READY=1")
+	})
+}
+
+// status sets the free text status shown by systemctl status.
+func (notifier *systemdNotifier) status(status string) {
+	notifier.notify("STATUS=" + status)
+}
+
+// extendStartTimeout asks systemd to wait at least this much longer for the bridge to become ready.
+func (notifier *systemdNotifier) extendStartTimeout(timeout time.Duration) {
+	notifier.notify(fmt.Sprintf("EXTEND_TIMEOUT_USEC=%d", timeout.Microseconds()))
+}
+
+// watchdog tells systemd that the poll loop is alive.
+func (notifier *systemdNotifier) watchdog() {
+	if notifier.watchdogInterval > 0 {
+		notifier.notify("WATCHDOG=1")
+	}
+}
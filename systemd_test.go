@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// listenNotifySocket points NOTIFY_SOCKET at a socket of the test's own, like systemd does for Type=notify.
+func listenNotifySocket(t *testing.T) *net.UnixConn {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %v", socket, err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", socket)
+	return conn
+}
+
+func receiveNotification(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	buffer := make([]byte, 4096)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		t.Fatalf("no notification received: %v", err)
+	}
+	return string(buffer[:n])
+}
+
+func TestSystemdNotifier(t *testing.T) {
+	conn := listenNotifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "20000000")
+	notifier := newSystemdNotifier()
+	if notifier.watchdogInterval != 20*time.Second {
+		t.Errorf("watchdog interval is %s, expected 20s", notifier.watchdogInterval)
+	}
+
+	notifier.status("Polled 8 points")
+	notifier.ready()
+	// Only the first ready is sent
+	notifier.ready()
+	notifier.watchdog()
+
+	for _, expected := range []string{"STATUS=Polled 8 points", "READY=1", "WATCHDOG=1"} {
+		if notification := receiveNotification(t, conn); notification != expected {
+			t.Errorf("received %q, expected %q", notification, expected)
+		}
+	}
+}
+
+func TestSystemdNotifierWithoutWatchdog(t *testing.T) {
+	conn := listenNotifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "")
+	notifier := newSystemdNotifier()
+
+	notifier.watchdog()
+	notifier.ready()
+	if notification := receiveNotification(t, conn); notification != "READY=1" {
+		t.Errorf("received %q, expected READY=1 and no WATCHDOG=1", notification)
+	}
+}
+
+func TestSystemdNotifierWithoutSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	notifier := newSystemdNotifier()
+	// Must not fail without systemd
+	notifier.ready()
+	notifier.status("Polled 8 points")
+	notifier.watchdog()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"github.com/SourceForgery/duc2mqtt/bastec"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+var _ Sink = (*webUiSink)(nil)
+
+//go:embed webui/index.html
+var webUiIndex []byte
+
+// WebUiPoint is a point on the DUC as shown in the web ui.
+type WebUiPoint struct {
+	Pid         string     `json:"pid"`
+	Prefix      string     `json:"prefix"`
+	Desc        string     `json:"desc"`
+	Unit        string     `json:"unit"`
+	Type        string     `json:"type"`
+	Acc         string     `json:"acc"`
+	Publish     bool       `json:"publish"`
+	Name        string     `json:"name"`
+	UnitSetting string     `json:"unitSetting"`
+	DeviceClass string     `json:"deviceClass"`
+	Value       *float64   `json:"value"`
+	Time        *time.Time `json:"time"`
+}
+
+// webUiSink serves a web ui for choosing which points are published and how. The values are those of the
+// bridge's registry.
+type webUiSink struct {
+	bridge *bridge
+}
+
+func newWebUiSink(mux *http.ServeMux, bridge *bridge) *webUiSink {
+	sink := &webUiSink{
+		bridge: bridge,
+	}
+	mux.HandleFunc("GET /ui/{$}", sink.index)
+	mux.HandleFunc("GET /ui/points", sink.listPoints)
+	mux.HandleFunc("PUT /ui/points", writeHandler(bridge.config.Http.AllowWrites, sink.putPoints))
+	return sink
+}
+
+func (sink *webUiSink) Name() string {
+	return "webui"
+}
+
+func (sink *webUiSink) PublishPoints(_ []bastec.PointConfig) error {
+	return nil
+}
+
+func (sink *webUiSink) PublishValues(_ time.Time, _ []bastec.Point) error {
+	return nil
+}
+
+func (sink *webUiSink) index(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(webUiIndex)
+}
+
+// listPoints lists every browsed point, sorted by prefix. Points that aren't polled are fetched from the DUC, so
+// that they have live values too.
+func (sink *webUiSink) listPoints(w http.ResponseWriter, r *http.Request) {
+	if unpolled := sink.bridge.unpolledPids(); len(unpolled) > 0 {
+		values, err := sink.bridge.ducClient.GetValuesContext(r.Context(), unpolled)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Failed to fetch the values of %d points that aren't polled", len(unpolled))
+		} else {
+			sink.bridge.registry.MergeValues(values)
+		}
+	}
+
+	browsed, pointSettings := sink.bridge.browsedPoints()
+	settingsByPid := make(map[string]PointSettings, len(pointSettings))
+	for _, settings := range pointSettings {
+		settingsByPid[settings.Pid] = settings
+	}
+
+	webUiPoints := make([]WebUiPoint, 0, len(browsed))
+	for _, point := range browsed {
+		settings, found := settingsByPid[point.Pid]
+		webUiPoint := WebUiPoint{
+			Pid:         point.Pid,
+			Desc:        point.Desc,
+			Unit:        point.Attr,
+			Type:        point.Type,
+			Acc:         point.Acc,
+			Publish:     len(settingsByPid) == 0 || (found && !settings.Disabled),
+			Name:        settings.Name,
+			UnitSetting: settings.Unit,
+			DeviceClass: settings.DeviceClass,
+		}
+		if prefixes := pidPrefixes(point.Pid); len(prefixes) > 0 {
+			webUiPoint.Prefix = prefixes[len(prefixes)-1]
+		}
+		if registeredPoint, found := sink.bridge.registry.Point(point.Pid); found && registeredPoint.HasValue {
+			webUiPoint.Value = &registeredPoint.Value
+			webUiPoint.Time = &registeredPoint.Time
+		}
+		webUiPoints = append(webUiPoints, webUiPoint)
+	}
+	// The ui groups runs of points with the same prefix, which needn't be contiguous in browse order
+	slices.SortStableFunc(webUiPoints, func(a, b WebUiPoint) int {
+		return strings.Compare(a.Prefix, b.Prefix)
+	})
+	writeJson(w, http.StatusOK, webUiPoints)
+}
+
+// putPoints replaces the settings of the points shown in the ui. Settings of other points are kept.
+func (sink *webUiSink) putPoints(w http.ResponseWriter, r *http.Request) {
+	var updated []PointSettings
+	if err := json.NewDecoder(r.Body).Decode(&updated); err != nil {
+		writeJsonError(w, http.StatusBadRequest, "expected a list of point settings")
+		return
+	}
+
+	_, current := sink.bridge.browsedPoints()
+	currentByPid := make(map[string]PointSettings, len(current))
+	for _, settings := range current {
+		currentByPid[settings.Pid] = settings
+	}
+	updatedPids := make(map[string]bool, len(updated))
+	for i, settings := range updated {
+		updatedPids[settings.Pid] = true
+		// The ui doesn't edit deadbands, keep them
+		if settings.Deadband == nil {
+			updated[i].Deadband = currentByPid[settings.Pid].Deadband
+		}
+	}
+	for _, settings := range current {
+		if !updatedPids[settings.Pid] {
+			updated = append(updated, settings)
+		}
+	}
+
+	if err := sink.bridge.updatePointSettings(updated); err != nil {
+		log.Error().Err(err).Msg("Failed to update point settings")
+		writeJsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
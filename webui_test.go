@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestListPointsSortsByPrefix(t *testing.T) {
+	// The DUC can't be reached, so the points that aren't polled are listed without values
+	bridge := newCachedBridge(t, &Config{Points: []PointSettings{{Pid: "1.ai.1"}}})
+	bridge.loadCache()
+	mux := http.NewServeMux()
+	newWebUiSink(mux, bridge)
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/ui/points", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got the status %d", recorder.Code)
+	}
+	var points []WebUiPoint
+	if err := json.NewDecoder(recorder.Body).Decode(&points); err != nil {
+		t.Fatal(err)
+	}
+	var pids []string
+	for _, point := range points {
+		pids = append(pids, point.Pid)
+	}
+	// Browse order within a prefix is kept
+	if !slices.Equal(pids, []string{"1.ai.1", "1.ai.2", "1.em.1"}) {
+		t.Errorf("listed %v, expected the points grouped by prefix", pids)
+	}
+}